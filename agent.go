@@ -0,0 +1,146 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+
+	"sessionm/shared/log"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// errors
+var (
+	NoAgent = errors.New("No ssh-agent is running (SSH_AUTH_SOCK is not set)")
+)
+
+// The connection to the ssh-agent, which is shared by every auth method using it and redialed if SSH_AUTH_SOCK
+// changes or the agent stops responding
+var systemAgent struct {
+	sync.Mutex
+	socket string
+	conn   net.Conn
+	client agent.ExtendedAgent
+}
+
+// Returns a client for the ssh-agent listening on SSH_AUTH_SOCK
+func getSystemAgent() (agent.ExtendedAgent, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, NoAgent
+	}
+	systemAgent.Lock()
+	defer systemAgent.Unlock()
+	if systemAgent.client != nil && systemAgent.socket == socket {
+		return systemAgent.client, nil
+	}
+	if systemAgent.conn != nil {
+		systemAgent.conn.Close()
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	systemAgent.socket, systemAgent.conn, systemAgent.client = socket, conn, agent.NewClient(conn)
+	return systemAgent.client, nil
+}
+
+// Drops the shared agent connection after it failed so that the next use redials it
+func resetSystemAgent(client agent.ExtendedAgent) {
+	systemAgent.Lock()
+	defer systemAgent.Unlock()
+	if systemAgent.client == client {
+		systemAgent.conn.Close()
+		systemAgent.conn, systemAgent.client = nil, nil
+	}
+}
+
+// Returns the signers for the keys held by the ssh-agent at SSH_AUTH_SOCK
+func AgentSigners() ([]ssh.Signer, error) {
+	client, err := getSystemAgent()
+	if err != nil {
+		return nil, err
+	}
+	signers, err := client.Signers()
+	if err != nil {
+		// the agent may have been restarted on the same socket
+		resetSystemAgent(client)
+		if client, err = getSystemAgent(); err != nil {
+			return nil, err
+		}
+		signers, err = client.Signers()
+	}
+	return signers, err
+}
+
+// Returns an auth method offering the keys held by the ssh-agent at SSH_AUTH_SOCK, if one is running, followed by
+// the private keys at keyPaths. Passphrase protected keys are decrypted with DefaultPassphraseCallback. An error is
+// returned if any of the private keys can't be parsed.
+//
+// The ssh package only tries the first public key auth method in a config, so every key has to be offered by this
+// one method rather than through one method per key source
+func PublicKeyAuth(keyPaths ...string) (ssh.AuthMethod, error) {
+	fileSigners, err := privateKeySigners(keyPaths, false)
+	if err != nil {
+		return nil, err
+	}
+	return agentAndKeysAuth(fileSigners), nil
+}
+
+// Parses the private keys at keyPaths. With skipInvalid the keys which can't be parsed, or are passphrase protected
+// while DefaultPassphraseCallback is nil, are logged and left out, as ssh does with its default keys
+func privateKeySigners(keyPaths []string, skipInvalid bool) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	for _, keyPath := range keyPaths {
+		signer, err := parsePrivateKeySigner(keyPath, DefaultPassphraseCallback)
+		if err != nil && skipInvalid {
+			log.Infof("Skipping private key %s (%s)", keyPath, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// Returns an auth method offering the ssh-agent's keys followed by fileSigners
+func agentAndKeysAuth(fileSigners []ssh.Signer) ssh.AuthMethod {
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		signers, err := AgentSigners()
+		if err != nil && len(fileSigners) == 0 {
+			return nil, err
+		}
+		return append(signers, fileSigners...), nil
+	})
+}
+
+// Whether an ssh-agent appears to be running
+func agentAvailable() bool {
+	_, err := getSystemAgent()
+	return err == nil
+}
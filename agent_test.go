@@ -0,0 +1,133 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// testKeyServer only accepts one public key, and records every key offered to it
+type testKeyServer struct {
+	*testPublicKeyServer
+	accepted ssh.PublicKey
+
+	mu      sync.Mutex
+	offered []ssh.PublicKey
+}
+
+func (t *testKeyServer) PublicKeyCallback() func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		t.mu.Lock()
+		t.offered = append(t.offered, key)
+		t.mu.Unlock()
+		if !bytes.Equal(key.Marshal(), t.accepted.Marshal()) {
+			return nil, errors.New("Public key not accepted")
+		}
+		return nil, nil
+	}
+}
+
+func TestAgentAuth(t *testing.T) {
+	Convey("Given an ssh-agent on a unix socket holding a key the server accepts", t, func() {
+		_, agentKey, err := ed25519.GenerateKey(rand.Reader)
+		So(err, ShouldBeNil)
+		agentSigner, err := ssh.NewSignerFromKey(agentKey)
+		So(err, ShouldBeNil)
+		keyring := agent.NewKeyring()
+		So(keyring.Add(agent.AddedKey{PrivateKey: agentKey}), ShouldBeNil)
+
+		dir, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+		socket := filepath.Join(dir, "agent.sock")
+		agentListener, err := net.Listen("unix", socket)
+		So(err, ShouldBeNil)
+		go func() {
+			for {
+				c, err := agentListener.Accept()
+				if err != nil {
+					return
+				}
+				go agent.ServeAgent(keyring, c)
+			}
+		}()
+		oldSocket := os.Getenv("SSH_AUTH_SOCK")
+		os.Setenv("SSH_AUTH_SOCK", socket)
+
+		keyServer := &testKeyServer{testPublicKeyServer: newTestPublicKeyServer(), accepted: agentSigner.PublicKey()}
+		server, err := startTestServer(keyServer)
+		So(err, ShouldBeNil)
+		keyPath := filepath.Join(dir, "id_rsa")
+		So(ioutil.WriteFile(keyPath, []byte(testPrivateKey), 0600), ShouldBeNil)
+
+		connect := func(auth ssh.AuthMethod) error {
+			config := &ssh.ClientConfig{User: CurrentUser, Auth: []ssh.AuthMethod{auth}, HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+			conn, err := GetSshConn(server.Addr().String(), config)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}
+
+		Convey("Authenticate with only the agent's keys", func() {
+			auth, err := PublicKeyAuth()
+			So(err, ShouldBeNil)
+			So(connect(auth), ShouldBeNil)
+		})
+
+		Convey("The agent's keys should be offered before file keys", func() {
+			auth, err := PublicKeyAuth(keyPath)
+			So(err, ShouldBeNil)
+			So(connect(auth), ShouldBeNil)
+			So(keyServer.offered, ShouldNotBeEmpty)
+			So(keyServer.offered[0].Marshal(), ShouldResemble, agentSigner.PublicKey().Marshal())
+		})
+
+		Convey("File keys should still be used without an agent", func() {
+			os.Unsetenv("SSH_AUTH_SOCK")
+			fileSigner, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+			So(err, ShouldBeNil)
+			keyServer.accepted = fileSigner.PublicKey()
+			auth, err := PublicKeyAuth(keyPath)
+			So(err, ShouldBeNil)
+			So(connect(auth), ShouldBeNil)
+		})
+
+		Reset(func() {
+			os.Setenv("SSH_AUTH_SOCK", oldSocket)
+			server.Close()
+			agentListener.Close()
+			os.RemoveAll(dir)
+		})
+	})
+}
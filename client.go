@@ -23,19 +23,17 @@
 package ssh
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path"
-	"path/filepath"
 	"sessionm/shared/log"
-	"strings"
 
 	"os/user"
 
-	"runtime"
+	"strconv"
 
 	"net"
 
@@ -45,169 +43,284 @@ import (
 )
 
 var (
-	CurrentUser           string
-	DefaultClientConfig   *ssh.ClientConfig
-	defaultPrivateKeyPath string
+	CurrentUser         string
+	DefaultClientConfig *ssh.ClientConfig
+
+	// The private keys looked for by SetupDefaultClientConfig, in the order they are offered
+	DefaultPrivateKeyPaths []string
+
+	// The known_hosts file and policy used by SetupDefaultClientConfig to verify host keys
+	DefaultKnownHostsPath string
+	DefaultHostKeyPolicy  = HostKeyStrict
+	// the KnownHosts of DefaultClientConfig, which restricts the host key algorithms for each address
+	defaultKnownHosts *KnownHosts
+
+	// The ssh_config files read by ResolveHost, in order of precedence
+	DefaultSshConfigPaths []string
+
+	// The control socket of a host's ControlMaster when ssh_config sets no ControlPath. %C is expanded to a hash of
+	// the user, host name and port
+	DefaultControlPath string
+
+	// The current user's home directory
+	homeDir string
 )
 
 // errors
 var (
 	FileNotFound = errors.New("No such file or directory")
 	FileExists   = errors.New("File or directory already exists")
+	NoPrivateKey = errors.New("No private key found and no ssh-agent is running")
 )
 
 func init() {
 	u, _ := user.Current()
 	CurrentUser = u.Username
+	homeDir = u.HomeDir
 	setDefaultKeyLocations()
 }
 
-// Sets the default private key locations per operating system
+// Sets the default private key locations in the user's home directory
 func setDefaultKeyLocations() {
-	if runtime.GOOS == "darwin" {
-		defaultPrivateKeyPath = fmt.Sprintf("/Users/%s/.ssh/id_rsa", CurrentUser)
-	} else if runtime.GOOS == "linux" {
-		defaultPrivateKeyPath = fmt.Sprintf("/home/%s/.ssh/id_rsa", CurrentUser)
-	} else {
-		fmt.Printf("OS: %s not supported (ssh)", runtime.GOOS)
-	}
+	sshDir := path.Join(homeDir, ".ssh")
+	DefaultPrivateKeyPaths = []string{
+		path.Join(sshDir, "id_ed25519"),
+		path.Join(sshDir, "id_ecdsa"),
+		path.Join(sshDir, "id_rsa"),
+	}
+	DefaultKnownHostsPath = path.Join(sshDir, "known_hosts")
+	DefaultSshConfigPaths = []string{path.Join(sshDir, "config"), "/etc/ssh/ssh_config"}
+	DefaultControlPath = path.Join(sshDir, "control", "%C")
 }
 
-// Attemps to parse the default private key and returns an ssh.AuthMethod and error
-func parseDefaultPrivateKey() (ssh.AuthMethod, error) {
-	return ParsePrivateKey(defaultPrivateKeyPath)
+// Parses a PEM or OpenSSH format private key file and returns an ssh.AuthMethod. Passphrase protected keys are
+// decrypted with DefaultPassphraseCallback
+func ParsePrivateKey(keyPath string) (ssh.AuthMethod, error) {
+	return ParsePrivateKeyWithPassphrase(keyPath, DefaultPassphraseCallback)
 }
 
-// Parses a private key file and returns an ssh.AuthMethod
-func ParsePrivateKey(keyPath string) (ssh.AuthMethod, error) {
-	keyData, err := ioutil.ReadFile(keyPath)
-	if err != nil {
-		return nil, err
-	}
-	privateKey, err := ssh.ParsePrivateKey(keyData)
+// Parses a PEM or OpenSSH format private key file and returns an ssh.AuthMethod. Passphrase protected keys are
+// decrypted with the passphrase returned by callback
+func ParsePrivateKeyWithPassphrase(keyPath string, callback PassphraseCallback) (ssh.AuthMethod, error) {
+	privateKey, err := parsePrivateKeySigner(keyPath, callback)
 	if err != nil {
 		return nil, err
 	}
 	return ssh.PublicKeys(privateKey), nil
 }
 
-// Sets up the default client configuration, including default private key and current user
+// Sets up the default client configuration, including the ssh-agent's keys, the default private keys which exist and
+// can be parsed, and the current user. Host keys are verified against DefaultKnownHostsPath with DefaultHostKeyPolicy
 func SetupDefaultClientConfig() error {
-	auth, err := parseDefaultPrivateKey()
+	fileSigners, _ := privateKeySigners(existingFiles(DefaultPrivateKeyPaths), true)
+	if len(fileSigners) == 0 && !agentAvailable() {
+		return NoPrivateKey
+	}
+	auth := agentAndKeysAuth(fileSigners)
+	knownHosts, err := NewKnownHosts(DefaultKnownHostsPath, DefaultHostKeyPolicy)
 	if err != nil {
 		return err
 	}
-	DefaultClientConfig = &ssh.ClientConfig{User: CurrentUser, Auth: []ssh.AuthMethod{auth}}
+	DefaultClientConfig = &ssh.ClientConfig{User: CurrentUser, Auth: []ssh.AuthMethod{auth}, HostKeyCallback: knownHosts.HostKeyCallback()}
+	defaultKnownHosts = knownHosts
 	return nil
 }
 
+// Returns the paths which exist
+func existingFiles(paths []string) []string {
+	var existing []string
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			existing = append(existing, p)
+		}
+	}
+	return existing
+}
+
 // Returns an SSH connection with the given config and url
 func GetSshConn(url string, config *ssh.ClientConfig) (*ssh.Client, error) {
-	return ssh.Dial("tcp", url, config)
+	return GetSshConnContext(context.Background(), url, config)
 }
 
-// Initiates a curl command from a remote session and returns the results
-func CurlFromRemote(conn *ssh.Client, url string, args ...string) ([]byte, error) {
-	session, err := conn.NewSession()
+// Returns an SSH connection with the given config and url, giving up if ctx is done first. config.Timeout limits
+// both connecting and the ssh handshake. With DefaultClientConfig the host is asked for a key of a type known for it,
+// as with HostConfig.ClientConfig
+func GetSshConnContext(ctx context.Context, url string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if config == DefaultClientConfig && defaultKnownHosts != nil && config.HostKeyAlgorithms == nil {
+		config = defaultKnownHosts.ClientConfig(config, url)
+	}
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", url)
 	if err != nil {
 		return nil, err
 	}
-	defer session.Close()
-	cmd := "curl"
-	for _, s := range args {
-		// handle double escaped quotes
-		if strings.Contains(s, "\\\"\"") {
-			s = strings.Replace(s, "\\\"\"", "\"", -1)
+	return newClientContext(ctx, conn, url, config)
+}
+
+// Runs the ssh handshake over conn, closing conn if ctx is done first
+func newClientContext(ctx context.Context, conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var client *ssh.Client
+	err := withContext(ctx, conn, func() error {
+		c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+		if err != nil {
+			return err
 		}
+		client = ssh.NewClient(c, chans, reqs)
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// Initiates a curl command from a remote session and returns the results. args are passed to curl exactly as given,
+// so they should not be quoted
+func CurlFromRemote(conn *ssh.Client, url string, args ...string) ([]byte, error) {
+	return CurlFromRemoteContext(context.Background(), conn, url, args...)
+}
 
-		cmd = fmt.Sprintf("%s %s", cmd, s)
+// Runs curl like CurlFromRemote, closing the session if ctx is done before curl exits
+func CurlFromRemoteContext(ctx context.Context, conn *ssh.Client, url string, args ...string) ([]byte, error) {
+	result, err := RunContext(ctx, conn, NewCommand("curl", args...).Arg("--", url).String())
+	if result == nil {
+		return nil, err
 	}
-	cmd = fmt.Sprintf(`%s "%s"`, cmd, url)
-	return session.Output(cmd)
+	return result.Stdout, err
 }
 
-// Makes a remote directory
+// Makes a remote directory, using sftp if the server supports it
 func MakeRemoteDir(conn *ssh.Client, dirname string) error {
-	_, err := StatRemoteFile(conn, dirname)
-	if err == nil {
-		return FileExists
-	}
-	session, err := conn.NewSession()
-	defer session.Close()
-	resp, err := session.Output("mkdir " + dirname)
-	if err != nil {
+	return MakeRemoteDirContext(context.Background(), conn, dirname)
+}
+
+// Makes a remote directory like MakeRemoteDir, giving up if ctx is done first
+func MakeRemoteDirContext(ctx context.Context, conn *ssh.Client, dirname string) error {
+	if ok, err := withRemoteFS(ctx, conn, func(rfs *RemoteFS) error {
+		if _, err := rfs.Lstat(dirname); err == nil {
+			return FileExists
+		}
+		return rfs.Mkdir(dirname)
+	}); ok {
 		return err
 	}
-	if string(resp) == "" {
-		return nil
-	} else {
-		return errors.New(string(resp))
+
+	_, err := StatRemoteFileContext(ctx, conn, dirname)
+	if err == nil {
+		return FileExists
 	}
+	_, err = RunContext(ctx, conn, NewCommand("mkdir", "--", dirname).String())
+	return err
 }
 
-// Remotes a remote directory
+// Removes a remote directory, using sftp if the server supports it
 func RemoveRemoteDir(conn *ssh.Client, dirname string) error {
-	if !DoesRemoteFileExist(conn, dirname) {
-		return FileNotFound
-	}
-	session, err := conn.NewSession()
-	if err != nil {
-		return err
-	}
-	defer session.Close()
-	resp, err := session.Output("rmdir " + dirname)
-	if err != nil {
+	return RemoveRemoteDirContext(context.Background(), conn, dirname)
+}
+
+// Removes a remote directory like RemoveRemoteDir, giving up if ctx is done first
+func RemoveRemoteDirContext(ctx context.Context, conn *ssh.Client, dirname string) error {
+	if ok, err := withRemoteFS(ctx, conn, func(rfs *RemoteFS) error {
+		return sftpError(rfs.RemoveDir(dirname))
+	}); ok {
 		return err
 	}
-	if string(resp) == "" {
-		return nil
-	} else {
-		return errors.New(string(resp))
+
+	if !DoesRemoteFileExistContext(ctx, conn, dirname) {
+		return FileNotFound
 	}
+	_, err := RunContext(ctx, conn, NewCommand("rmdir", "--", dirname).String())
+	return err
 }
 
-// Removes a remote file
+// Removes a remote file, using sftp if the server supports it
 func RemoveRemoteFile(conn *ssh.Client, filepath string) error {
-	if !DoesRemoteFileExist(conn, filepath) {
-		return FileNotFound
-	}
-	session, err := conn.NewSession()
-	if err != nil {
-		return err
-	}
-	defer session.Close()
-	resp, err := session.Output("rm " + filepath)
-	if err != nil {
+	return RemoveRemoteFileContext(context.Background(), conn, filepath)
+}
+
+// Removes a remote file like RemoveRemoteFile, giving up if ctx is done first
+func RemoveRemoteFileContext(ctx context.Context, conn *ssh.Client, filepath string) error {
+	if ok, err := withRemoteFS(ctx, conn, func(rfs *RemoteFS) error {
+		if info, err := rfs.Lstat(filepath); err == nil && info.IsDir() {
+			return fmt.Errorf("%s is a directory", filepath)
+		}
+		return sftpError(rfs.Remove(filepath))
+	}); ok {
 		return err
 	}
-	if string(resp) == "" {
-		return nil
-	} else {
-		return errors.New(string(resp))
+
+	if !DoesRemoteFileExistContext(ctx, conn, filepath) {
+		return FileNotFound
 	}
+	_, err := RunContext(ctx, conn, NewCommand("rm", "--", filepath).String())
+	return err
 }
 
-// Gets the Stat information from a remote file
-func StatRemoteFile(conn *ssh.Client, remoteOutPath string) ([]byte, error) {
-	session, err := conn.NewSession()
-	if err != nil {
-		return nil, err
+// Gets the Stat information from a remote file by running stat, or over sftp if the server can't run it. FileNotFound
+// is returned if it does not exist
+func StatRemoteFile(conn *ssh.Client, remoteOutPath string) (*RemoteFileInfo, error) {
+	return StatRemoteFileContext(context.Background(), conn, remoteOutPath)
+}
+
+// Gets the Stat information from a remote file like StatRemoteFile, closing the session if ctx is done first
+func StatRemoteFileContext(ctx context.Context, conn *ssh.Client, remoteOutPath string) (*RemoteFileInfo, error) {
+	result, err := RunContext(ctx, conn, statCommand(remoteOutPath))
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) && cmdErr.ExitStatus() == statNotFoundStatus {
+		return nil, FileNotFound
 	}
-	defer session.Close()
-	statResp, err := session.Output("stat " + remoteOutPath)
-	if err != nil {
+	if err == nil {
+		return parseStat(remoteOutPath, result.Stdout)
+	}
+	if ctx.Err() != nil {
 		return nil, err
 	}
-	//fmt.Println(string(statResp))
-	if strings.Contains(string(statResp), "No such file or directory") {
-		return nil, FileNotFound
+
+	// a server which can't run stat may still serve sftp, which describes the file without its owner and group names,
+	// links or inode
+	var info *RemoteFileInfo
+	if ok, sftpErr := withRemoteFS(ctx, conn, func(rfs *RemoteFS) error {
+		fi, err := rfs.Lstat(remoteOutPath)
+		if err != nil {
+			return err
+		}
+		info = sftpFileInfo(remoteOutPath, fi)
+		if fi.Mode()&os.ModeSymlink != 0 {
+			info.LinkTarget, err = rfs.Readlink(remoteOutPath)
+		}
+		return err
+	}); ok {
+		if sftpErr != nil {
+			return nil, sftpError(sftpErr)
+		}
+		return info, nil
 	}
-	return statResp, nil
+	return nil, err
 }
 
-// Checks to see if the remote file exists
+// Checks to see if the remote file exists, using sftp if the server supports it
 func DoesRemoteFileExist(conn *ssh.Client, filepath string) bool {
-	_, err := StatRemoteFile(conn, filepath)
+	return DoesRemoteFileExistContext(context.Background(), conn, filepath)
+}
+
+// Checks to see if the remote file exists like DoesRemoteFileExist. false is returned if ctx is done first
+func DoesRemoteFileExistContext(ctx context.Context, conn *ssh.Client, filepath string) bool {
+	exists := false
+	if ok, _ := withRemoteFS(ctx, conn, func(rfs *RemoteFS) error {
+		_, err := rfs.Lstat(filepath)
+		exists = err == nil
+		return nil
+	}); ok {
+		return exists
+	}
+
+	_, err := StatRemoteFileContext(ctx, conn, filepath)
 	if err != nil {
 		return false
 	}
@@ -216,17 +329,32 @@ func DoesRemoteFileExist(conn *ssh.Client, filepath string) bool {
 
 // Copies data to a file on a remote machine over ssh with default permissions
 func Copy(conn *ssh.Client, filename, destinationPath string, data []byte) error {
-	return CopyWithFileMode(os.FileMode(0664), filename, destinationPath, data, conn)
+	return CopyContext(context.Background(), conn, filename, destinationPath, data)
+}
+
+// Copies data like Copy, closing the session if ctx is done first
+func CopyContext(ctx context.Context, conn *ssh.Client, filename, destinationPath string, data []byte) error {
+	return CopyWithFileModeContext(ctx, os.FileMode(0664), filename, destinationPath, data, conn)
 }
 
 // Copies data to a file on a remote machine over ssh with a specific file mode
 func CopyWithFileMode(mode os.FileMode, filename, destinationPath string, data []byte, conn *ssh.Client) error {
+	return CopyWithFileModeContext(context.Background(), mode, filename, destinationPath, data, conn)
+}
+
+// Copies data like CopyWithFileMode, closing the session if ctx is done first
+func CopyWithFileModeContext(ctx context.Context, mode os.FileMode, filename, destinationPath string, data []byte, conn *ssh.Client) error {
 	reader := bytes.NewReader(data)
-	return _copy(int64(len(data)), mode, filename, destinationPath, reader, conn)
+	return _copy(ctx, int64(len(data)), mode, filename, destinationPath, reader, conn)
 }
 
 // Copies a file from the local machine to a remote path, preserving existing permissions
 func CopyFile(filePath, destinationPath string, conn *ssh.Client) error {
+	return CopyFileContext(context.Background(), filePath, destinationPath, conn)
+}
+
+// Copies a file like CopyFile, closing the session if ctx is done first
+func CopyFileContext(ctx context.Context, filePath, destinationPath string, conn *ssh.Client) error {
 	f, err := os.Open(filePath)
 	if err != nil {
 		return err
@@ -236,67 +364,60 @@ func CopyFile(filePath, destinationPath string, conn *ssh.Client) error {
 	if err != nil {
 		return err
 	}
-	return _copy(s.Size(), s.Mode().Perm(), path.Base(filePath), destinationPath, f, conn)
+	return _copy(ctx, s.Size(), s.Mode().Perm(), path.Base(filePath), destinationPath, f, conn)
 }
 
-// Copies data from the local machine to the remote machine
-func _copy(size int64, mode os.FileMode, fileName, destination string, contents io.Reader, conn *ssh.Client) error {
-	session, err := conn.NewSession()
+// Copies data from the local machine to the remote machine, checking the remote scp's response to every step
+func _copy(ctx context.Context, size int64, mode os.FileMode, fileName, destination string, contents io.Reader, conn *ssh.Client) error {
+	c, err := startScp(conn, "-t", "--", destination)
 	if err != nil {
 		return err
 	}
-	defer session.Close()
-
-	cmd := "scp -t " + destination
-	// Done synchronously in order to verify that the file is there before we attempt to remove it in testing.
-	// This can be safely run from a goroutine, and a call to session.Run(cmd) will return immediately
-	// In that case, it would be best to do something like:
-	/*
-		go func(){
-			w, _ := session.StdinPipe()
-			fmt.Fprintf(w, "C%#o %d %s\n", mode, size, fileName)
-			io.Copy(w, contents)
-			w.Write([]byte("\x00)
-		}()
+	defer c.Close()
 
-		err := session.Run(cmd)
-		if err != nil {
+	return withContext(ctx, c, func() error {
+		// the remote scp announces that it is ready before anything is sent
+		if err := c.readAck(); err != nil {
 			return err
 		}
-	*/
-	w, _ := session.StdinPipe()
-	if err := session.Start(cmd); err != nil {
-		return err
-	}
-
-	_, err = w.Write([]byte(fmt.Sprintf("C%#o %d %s\n", mode, size, fileName)))
-	if err != nil {
-		return err
-	}
-	io.Copy(w, contents)
-	_, err = w.Write([]byte("\x00"))
-	if err != nil {
-		return err
-	}
-	err = w.Close()
-	return err
+		if err := c.send(scpRecord{Type: 'C', Mode: mode, Size: size, Name: fileName}); err != nil {
+			return err
+		}
+		if err := c.sendContents(size, contents); err != nil {
+			return err
+		}
+		return c.finish()
+	})
 }
 
-// Retrieves a remote file very inefficiently. This can be done better
+// Retrieves a remote file over scp, buffering its contents in memory. Use CopyFromRemote or CopyFileFromRemote to
+// stream larger files
 func GetRemoteFile(path string, conn *ssh.Client) (data []byte, filename string, err error) {
-	_, err = StatRemoteFile(conn, path)
+	return GetRemoteFileContext(context.Background(), path, conn)
+}
+
+// Retrieves a remote file like GetRemoteFile, closing the session if ctx is done first
+func GetRemoteFileContext(ctx context.Context, path string, conn *ssh.Client) (data []byte, filename string, err error) {
+	_, err = StatRemoteFileContext(ctx, conn, path)
 	if err != nil {
 		return
 	}
-	session, sErr := conn.NewSession()
-	if sErr != nil {
-		err = sErr
+	buf := bytes.NewBuffer([]byte{})
+	info, err := CopyFromRemoteContext(ctx, conn, path, buf)
+	if err != nil {
 		return
 	}
-	defer session.Close()
-	filename = filepath.Base(path)
-	data, err = session.Output(fmt.Sprintf("cat %s", path))
-	return
+	return buf.Bytes(), info.Name(), nil
+}
+
+// ForwardFunc opens a stream to url:port by way of conn. Writes to stdin are delivered to the remote host and its
+// responses are read from stdout, while stderr (which may be nil) carries any diagnostics produced along the way
+type ForwardFunc func(conn *ssh.Client, url string, port int) (stdin io.Writer, stdout io.Reader, stderr io.Reader, err error)
+
+// closeWriter is implemented by connections that support half-closing their write side, such as *net.TCPConn and
+// ssh.Channel
+type closeWriter interface {
+	CloseWrite() error
 }
 
 // Takes a connection, initiates a session, and returns pipes to stdin, stdout, and stderr while calling netcat to a remote
@@ -307,11 +428,22 @@ func ForwardNetcat(conn *ssh.Client, url string, port int) (stdin io.Writer, std
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	return stdin, stdout, stderr, session.Start(fmt.Sprintf("nc %s %d", url, port))
+	return stdin, stdout, stderr, session.Start(NewCommand("nc", url, strconv.Itoa(port)).String())
 }
 
-func getPipesAndSession(conn *ssh.Client) (stdin io.Writer, stdout io.Reader, stderr io.Reader, session *ssh.Session, err error) {
+// Opens a direct-tcpip channel from the remote machine to url:port. The returned stdin and stdout are the same
+// connection and stderr is always nil. Unlike ForwardNetcat, this does not depend on any binaries being installed on
+// the remote machine and preserves half-closed connections
+func ForwardDirectTcpip(conn *ssh.Client, url string, port int) (stdin io.Writer, stdout io.Reader, stderr io.Reader, err error) {
+	c, err := conn.Dial("tcp", net.JoinHostPort(url, strconv.Itoa(port)))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return c, c, nil, nil
+}
 
+// Starts a session with pipes connected to its stdin, stdout and stderr, ready for a command to be started
+func getPipesAndSession(conn *ssh.Client) (stdin io.WriteCloser, stdout io.Reader, stderr io.Reader, session *ssh.Session, err error) {
 	session, err = conn.NewSession()
 	if err != nil {
 		return nil, nil, nil, nil, err
@@ -324,7 +456,7 @@ func getPipesAndSession(conn *ssh.Client) (stdin io.Writer, stdout io.Reader, st
 }
 
 // Starts a forwarded listener by creating a server to listen on url
-func StartForwardedListener(conn *ssh.Client, url, remoteAddr string, port int, forwardFunc func(conn *ssh.Client, url string, port int) (stdin io.Writer, stdout io.Reader, stderr io.Reader, err error)) (chan bool, error) {
+func StartForwardedListener(conn *ssh.Client, url, remoteAddr string, port int, forwardFunc ForwardFunc) (chan bool, error) {
 	listener, err := net.Listen("tcp", url)
 	if err != nil {
 		return nil, err
@@ -336,58 +468,129 @@ func StartForwardedListener(conn *ssh.Client, url, remoteAddr string, port int,
 
 // Forwards traffic from the ssh session to and from the local listener by copying io.Writer and io.Reader writes on
 // the forwarded session
-func Forward(conn *ssh.Client, listener net.Listener, url string, port int, ret chan bool, forwardFunc func(conn *ssh.Client, url string, port int) (stdin io.Writer, stdout io.Reader, stderr io.Reader, err error)) error {
+func Forward(conn *ssh.Client, listener net.Listener, url string, port int, ret chan bool, forwardFunc ForwardFunc) error {
+	return forward(func() (*ssh.Client, error) {
+		return conn, nil
+	}, listener, url, port, forwardFunc)
+}
+
+// Forwards each connection accepted by listener through the ssh connection returned by getConn at the time
+func forward(getConn func() (*ssh.Client, error), listener net.Listener, url string, port int, forwardFunc ForwardFunc) error {
 	defer listener.Close()
 	for {
 		l, err := listener.Accept()
-		log.Info("Accepting connection...")
 		if err != nil {
-			fmt.Println(err)
+			log.Error(err)
 			return err
 		}
+		log.Infof("Accepting connection from %s...", l.RemoteAddr())
 		go func() {
-			log.Info("Starting session...")
-			stdin, stdout, stderr, err := forwardFunc(conn, url, port)
+			conn, err := getConn()
 			if err != nil {
-				log.Error(err)
+				log.Errorf("[%s] Could not forward to %s:%d (%s)", l.RemoteAddr(), url, port, err)
+				l.Close()
+				return
 			}
-			//copy local writer to remote reader
-			go func() {
-				// specifying a buffer allows us to print logs of the data being proxied
-				// it will not, however, print in real time
-				buf := make([]byte, 1024)
-				_, err = io.CopyBuffer(l, stdout, buf)
-				if err != nil {
-					log.Error(err)
-				}
-				log.Info("Copied data from stdout...")
-				log.Info(string(buf))
-			}()
-
-			//copy remote writer to local reader
-			go func() {
-				buf := make([]byte, 1024)
-				_, err = io.CopyBuffer(stdin, l, buf)
-				if err != nil {
-					log.Error(err)
-				}
-				log.Info("Copied data to stdin...")
-				log.Info(string(buf))
-			}()
-
-			go func() {
-				stderrBuffer := bytes.NewBuffer([]byte{})
-				_, err = io.Copy(stderrBuffer, stderr)
-				if err != nil {
-					log.Error(err)
-				}
-				if len(stderrBuffer.Bytes()) > 0 {
-					log.Error(string(stderrBuffer.Bytes()))
-					stderrBuffer.Reset()
-				}
-			}()
+			forwardConn(conn, l, url, port, forwardFunc)
+		}()
+	}
+}
 
+// Forwards a single accepted connection to url:port, logging any error against the connection's address
+func forwardConn(conn *ssh.Client, l net.Conn, url string, port int, forwardFunc ForwardFunc) {
+	stdin, stdout, stderr, err := forwardFunc(conn, url, port)
+	if err != nil {
+		log.Errorf("[%s] Could not forward to %s:%d (%s)", l.RemoteAddr(), url, port, err)
+		l.Close()
+		return
+	}
+	if stderr != nil {
+		go func() {
+			stderrBuffer := bytes.NewBuffer([]byte{})
+			_, err := io.Copy(stderrBuffer, stderr)
+			if err != nil {
+				log.Errorf("[%s] %s", l.RemoteAddr(), err)
+			}
+			if stderrBuffer.Len() > 0 {
+				log.Errorf("[%s] %s", l.RemoteAddr(), stderrBuffer.String())
+			}
 		}()
+	}
+	if err := proxy(stdin, stdout, l); err != nil {
+		log.Errorf("[%s] %s", l.RemoteAddr(), err)
+	}
+	if c, ok := stdin.(io.Closer); ok {
+		c.Close()
+	}
+	log.Infof("[%s] Connection closed", l.RemoteAddr())
+}
+
+// Copies local to remoteIn and remoteOut to local until both directions reach EOF, half-closing each side as its
+// source is exhausted so that the other direction can keep flowing. local is closed once both copies are done, and
+// the first copy error (if any) is returned
+func proxy(remoteIn io.Writer, remoteOut io.Reader, local net.Conn) error {
+	defer local.Close()
+	errs := make(chan error, 2)
+	go func() {
+		errs <- copyAndCloseWrite(local, remoteOut)
+	}()
+	go func() {
+		errs <- copyAndCloseWrite(remoteIn, local)
+	}()
+	err := <-errs
+	if err2 := <-errs; err == nil {
+		err = err2
+	}
+	return err
+}
 
+// Copies src to dst and then signals EOF on dst, preferring a half-close over a full close when dst supports it
+func copyAndCloseWrite(dst io.Writer, src io.Reader) error {
+	_, err := io.Copy(dst, src)
+	if cw, ok := dst.(closeWriter); ok {
+		cw.CloseWrite()
+	} else if c, ok := dst.(io.Closer); ok {
+		c.Close()
+	}
+	return err
+}
+
+// Asks the ssh server to listen on remoteAddr (the "tcpip-forward" global request) and forwards each connection it
+// accepts back to localAddr on this machine. This blocks until the remote listener is closed or the connection drops
+func StartReverseForward(conn *ssh.Client, remoteAddr, localAddr string) error {
+	listener, err := conn.Listen("tcp", remoteAddr)
+	if err != nil {
+		return err
+	}
+	log.Infof("[*] Remote host listening on %s...\n", listener.Addr())
+	return ReverseForward(listener, localAddr)
+}
+
+// Forwards every connection accepted by a remote listener, such as the one returned by (*ssh.Client).Listen, to
+// localAddr. The listener is closed when this returns
+func ReverseForward(listener net.Listener, localAddr string) error {
+	defer listener.Close()
+	for {
+		remote, err := listener.Accept()
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		log.Infof("Accepting remote connection from %s...", remote.RemoteAddr())
+		go reverseForwardConn(remote, localAddr)
+	}
+}
+
+// Connects a single remotely accepted connection to localAddr, logging any error against the remote address
+func reverseForwardConn(remote net.Conn, localAddr string) {
+	defer remote.Close()
+	local, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		log.Errorf("[%s] Could not connect to %s (%s)", remote.RemoteAddr(), localAddr, err)
+		return
+	}
+	if err := proxy(remote, remote, local); err != nil {
+		log.Errorf("[%s] %s", remote.RemoteAddr(), err)
 	}
+	log.Infof("[%s] Connection closed", remote.RemoteAddr())
 }
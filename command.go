@@ -0,0 +1,183 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"errors"
+	"strings"
+)
+
+// errors
+var (
+	UnterminatedQuote = errors.New("Unterminated quote in shell arguments")
+)
+
+// Command builds a command line to be run by the remote user's shell. Every argument is quoted, so arguments reach the
+// remote program exactly as given no matter which characters they contain
+type Command struct {
+	args     []string
+	env      []string
+	dir      string
+	sudo     bool
+	sudoUser string
+}
+
+// Returns a Command that runs name with the given arguments
+func NewCommand(name string, args ...string) *Command {
+	return &Command{args: append([]string{name}, args...)}
+}
+
+// Appends arguments to the command
+func (c *Command) Arg(args ...string) *Command {
+	c.args = append(c.args, args...)
+	return c
+}
+
+// Sets an environment variable for the command. Variables are set with env(1) rather than with ssh "env" requests,
+// which most servers reject
+func (c *Command) Env(key, value string) *Command {
+	c.env = append(c.env, key+"="+value)
+	return c
+}
+
+// Runs the command in dir instead of the remote user's home directory
+func (c *Command) Dir(dir string) *Command {
+	c.dir = dir
+	return c
+}
+
+// Runs the command as root with sudo. sudo is run non-interactively, so it fails rather than prompting for a password
+func (c *Command) Sudo() *Command {
+	c.sudo = true
+	return c
+}
+
+// Runs the command as user with sudo, non-interactively
+func (c *Command) SudoAs(user string) *Command {
+	c.sudo = true
+	c.sudoUser = user
+	return c
+}
+
+// Returns the command line to send to the remote shell
+func (c *Command) String() string {
+	var words []string
+	if c.dir != "" {
+		words = append(words, "cd", ShellQuote(c.dir), "&&")
+	}
+	if c.sudo {
+		words = append(words, "sudo", "-n")
+		if c.sudoUser != "" {
+			words = append(words, "-u", ShellQuote(c.sudoUser))
+		}
+		words = append(words, "--")
+	}
+	if len(c.env) > 0 {
+		words = append(words, "env")
+		for _, e := range c.env {
+			words = append(words, ShellQuote(e))
+		}
+	}
+	for _, arg := range c.args {
+		words = append(words, ShellQuote(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+// Quotes s for a POSIX shell. Strings made only of characters that are never special are returned unchanged, and
+// everything else is wrapped in single quotes
+func ShellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	safe := true
+	for _, r := range s {
+		if !isShellSafe(r) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	// a single quote can't appear inside single quotes, so it is closed, an escaped quote added, and it is reopened
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func isShellSafe(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("@%+:,./-_", r)
+}
+
+// Splits s into arguments the way a POSIX shell would, honouring single quotes, double quotes and backslash escapes.
+// No expansions are performed
+func SplitArgs(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			// inside double quotes a backslash only escapes characters that are otherwise special
+			if quote == '"' && !strings.ContainsRune("$`\"\\\n", r) {
+				current.WriteRune('\\')
+			}
+			current.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+			inArg = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, UnterminatedQuote
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Arguments that would break or inject commands if they were not quoted
+var hostileArgs = []string{"plain", "", "with spaces", "it's", `"double"`, "semi;colon", "$(whoami)", "`id`", "back\\slash", "new\nline", "*", "-n"}
+
+func TestCommand(t *testing.T) {
+	Convey("Building commands", t, func() {
+		Convey("Safe arguments should not be quoted", func() {
+			So(NewCommand("mkdir", "-p", "/tmp/a-b_c.d").String(), ShouldEqual, "mkdir -p /tmp/a-b_c.d")
+		})
+
+		Convey("Unsafe arguments should be single quoted", func() {
+			So(ShellQuote("with spaces"), ShouldEqual, "'with spaces'")
+			So(ShellQuote("it's"), ShouldEqual, `'it'\''s'`)
+			So(ShellQuote(""), ShouldEqual, "''")
+		})
+
+		Convey("A command word with = should be quoted so it is not taken as an assignment", func() {
+			So(NewCommand("a=b", "c=d").String(), ShouldEqual, "'a=b' 'c=d'")
+		})
+
+		Convey("Directory, sudo and environment should wrap the command", func() {
+			cmd := NewCommand("make", "install").Dir("/src/my app").SudoAs("deploy").Env("PREFIX", "/opt/my app")
+			So(cmd.String(), ShouldEqual, "cd '/src/my app' && sudo -n -u deploy -- env 'PREFIX=/opt/my app' make install")
+		})
+
+		Convey("SplitArgs should reverse ShellQuote", func() {
+			quoted := []string{}
+			for _, arg := range hostileArgs {
+				quoted = append(quoted, ShellQuote(arg))
+			}
+			args, err := SplitArgs(strings.Join(quoted, " "))
+			So(err, ShouldBeNil)
+			So(args, ShouldResemble, hostileArgs)
+		})
+
+		Convey("SplitArgs should handle double quotes and escapes", func() {
+			args, err := SplitArgs(`-H "Accept: application/json" -d a\ b "say \"hi\"" 'x'"y"`)
+			So(err, ShouldBeNil)
+			So(args, ShouldResemble, []string{"-H", "Accept: application/json", "-d", "a b", `say "hi"`, "xy"})
+
+			_, err = SplitArgs(`"unterminated`)
+			So(err, ShouldEqual, UnterminatedQuote)
+		})
+	})
+
+	Convey("Given a connection to an in-process ssh server", t, func() {
+		_, conn := newTestConn(t)
+
+		Convey("Quoted arguments should reach the remote program unchanged", func() {
+			session, err := conn.NewSession()
+			So(err, ShouldBeNil)
+			defer session.Close()
+			output, err := session.Output(NewCommand("printf", "%s\\0").Arg(hostileArgs...).Env("GREETING", "hello world").String())
+			So(err, ShouldBeNil)
+			So(strings.Split(strings.TrimSuffix(string(output), "\x00"), "\x00"), ShouldResemble, hostileArgs)
+		})
+	})
+}
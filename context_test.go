@@ -0,0 +1,94 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestContext(t *testing.T) {
+	Convey("Given an ssh server", t, func() {
+		_, conn := newTestConn(t)
+
+		Convey("A running command should be stopped when the context times out", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			_, err := RunContext(ctx, conn, "sleep 10")
+			So(err, ShouldEqual, context.DeadlineExceeded)
+			So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+
+			// the connection is still usable afterwards
+			result, err := RunContext(context.Background(), conn, "echo ok")
+			So(err, ShouldBeNil)
+			So(string(result.Stdout), ShouldEqual, "ok\n")
+		})
+
+		Convey("Operations should not start with a cancelled context", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := StatRemoteFileContext(ctx, conn, "/")
+			So(err, ShouldEqual, context.Canceled)
+			So(MakeRemoteDirContext(ctx, conn, "/tmp/never-made"), ShouldEqual, context.Canceled)
+			_, _, err = GetRemoteFileContext(ctx, "/etc/hostname", conn)
+			So(err, ShouldEqual, context.Canceled)
+			So(CopyContext(ctx, conn, "never-copied", "/tmp", []byte("data")), ShouldEqual, context.Canceled)
+		})
+	})
+
+	Convey("Given a server which never completes the ssh handshake", t, func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		go func() {
+			for {
+				c, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer c.Close()
+			}
+		}()
+		config, err := testClientConfig()
+		So(err, ShouldBeNil)
+
+		Convey("The handshake should be limited by the config's timeout", func() {
+			config.Timeout = 100 * time.Millisecond
+			_, err := GetSshConn(listener.Addr().String(), config)
+			So(err, ShouldEqual, context.DeadlineExceeded)
+		})
+
+		Convey("Dialing should stop when the context is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(100*time.Millisecond, cancel)
+			_, err := DialChainContext(ctx, Hop{Addr: listener.Addr().String(), Config: config})
+			So(err, ShouldEqual, context.Canceled)
+		})
+
+		Reset(func() {
+			listener.Close()
+		})
+	})
+}
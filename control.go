@@ -0,0 +1,497 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sessionm/shared/log"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The global requests a control connection sends to ask a master for its status and to stop it
+const (
+	controlCheckRequest = "check@control.sessionm"
+	controlStopRequest  = "stop@control.sessionm"
+)
+
+// errors
+var (
+	NoControlPath        = errors.New("No control path is configured for the host")
+	ControlMasterRunning = errors.New("A control master is already running on the control path")
+	NotAControlMaster    = errors.New("The control socket did not respond as a control master")
+	ControlDirInsecure   = errors.New("The control socket's directory must be owned by the current user and not writable by others")
+	ControlPeerNotUser   = errors.New("The control connection is not from the current user")
+)
+
+// ControlMaster holds a connection to a host open in the background, like ssh's ControlMaster. Later connections
+// made to its unix socket control path are ssh connections whose sessions, direct-tcpip channels and remote forwards
+// are relayed over the master's connection, so they neither authenticate again nor wait for a new handshake. Only the current user
+// can open the socket, and connections from other users' processes are refused, so the control connections are not
+// authenticated
+type ControlMaster struct {
+	client   *ManagedClient
+	host     string
+	path     string
+	listener net.Listener
+	config   *ssh.ServerConfig
+	started  time.Time
+
+	mu     sync.Mutex
+	conns  map[*ssh.ServerConn]bool
+	closed bool
+}
+
+// ControlStatus describes a running control master
+type ControlStatus struct {
+	// The control socket
+	Path string
+	// The host the master is connected to, as user@host:port
+	Host    string
+	Pid     int
+	Started time.Time
+	// The number of control connections currently using the master
+	Clients int
+}
+
+// The payload of a reply to a check request
+type controlStatusMsg struct {
+	Host    string
+	Pid     uint32
+	Started uint64
+	Clients uint32
+}
+
+// Connects to the host and starts listening on its ControlPath. Serve must be called to accept control connections.
+// The connection is kept alive and redialed when lost, like one from DialManaged
+func NewControlMaster(h *HostConfig) (*ControlMaster, error) {
+	if h.ControlPath == "" {
+		return nil, NoControlPath
+	}
+	if _, err := CheckControl(h.ControlPath); err == nil {
+		return nil, ControlMasterRunning
+	}
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	// the master dials the host itself rather than through its own control path, which would be tried on redials
+	hops, err := h.Hops()
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewManagedClient(func(ctx context.Context) (*ssh.Client, error) {
+		return DialChainContext(ctx, hops...)
+	}, h.KeepaliveInterval, h.KeepaliveCountMax)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := listenControl(h.ControlPath)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &ControlMaster{
+		client:   client,
+		host:     h.User + "@" + h.Addr(),
+		path:     h.ControlPath,
+		listener: listener,
+		config:   config,
+		started:  time.Now(),
+		conns:    make(map[*ssh.ServerConn]bool),
+	}, nil
+}
+
+// Listens on a unix socket at path which only the current user can connect to, replacing a socket left behind by a
+// master which did not exit cleanly. The socket's directory must belong to the user, so that no one else can replace
+// the socket
+func listenControl(path string) (net.Listener, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || int(stat.Uid) != os.Getuid() || info.Mode().Perm()&0022 != 0 {
+		return nil, ControlDirInsecure
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	// the socket is created with the umask's permissions, so it is narrowed first rather than chmodding afterwards
+	umask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	return listener, err
+}
+
+// Returns ControlPeerNotUser unless the process at the other end of a control connection is the current user's
+func checkControlPeer(conn net.Conn) error {
+	uid, err := peerUid(conn)
+	if err != nil {
+		return err
+	}
+	if uid != os.Getuid() {
+		return ControlPeerNotUser
+	}
+	return nil
+}
+
+// Accepts control connections until the master is closed or stopped, when nil is returned
+func (m *ControlMaster) Serve() error {
+	log.Infof("[*] Control master for %s listening on %s", m.host, m.path)
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			m.mu.Lock()
+			closed := m.closed
+			m.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		if err := checkControlPeer(conn); err != nil {
+			log.Errorf("Control connection rejected: %s", err)
+			conn.Close()
+			continue
+		}
+		go m.serveConn(conn)
+	}
+}
+
+// Stops listening, removing the control socket, and closes the control connections and the connection to the host
+func (m *ControlMaster) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	conns := m.conns
+	m.conns = nil
+	m.mu.Unlock()
+
+	err := m.listener.Close()
+	for conn := range conns {
+		conn.Close()
+	}
+	m.client.Close()
+	return err
+}
+
+// Serves a control connection, relaying its channels until it is closed
+func (m *ControlMaster) serveConn(conn net.Conn) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, m.config)
+	if err != nil {
+		log.Errorf("Control connection failed: %s", err)
+		return
+	}
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		serverConn.Close()
+		return
+	}
+	m.conns[serverConn] = true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.conns, serverConn)
+		m.mu.Unlock()
+	}()
+
+	go m.handleRequests(serverConn, requests)
+	for newChannel := range channels {
+		go m.relayChannel(newChannel)
+	}
+}
+
+// Answers a control connection's global requests. Remote forwards are opened on the master's connection, and the
+// connections made to them are relayed back as forwarded-tcpip channels until they are cancelled or the control
+// connection is closed
+func (m *ControlMaster) handleRequests(conn *ssh.ServerConn, requests <-chan *ssh.Request) {
+	var mu sync.Mutex
+	forwards := make(map[string]net.Listener)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, listener := range forwards {
+			listener.Close()
+		}
+		forwards = nil
+	}()
+
+	for req := range requests {
+		switch req.Type {
+		case controlCheckRequest:
+			req.Reply(true, ssh.Marshal(m.status()))
+		case controlStopRequest:
+			req.Reply(true, nil)
+			log.Infof("Control master for %s stopped", m.host)
+			go m.Close()
+		case "tcpip-forward":
+			var payload tcpipForwardPayload
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			listener, err := m.listen(payload)
+			if err != nil {
+				log.Errorf("Could not relay remote forward (%s)", err)
+				req.Reply(false, nil)
+				continue
+			}
+			port := uint32(listener.Addr().(*net.TCPAddr).Port)
+			key := net.JoinHostPort(payload.Addr, strconv.Itoa(int(port)))
+			mu.Lock()
+			forwards[key] = listener
+			mu.Unlock()
+			req.Reply(true, ssh.Marshal(struct{ Port uint32 }{port}))
+			go func() {
+				serveForwardedTcpip(conn, listener, payload.Addr, port)
+				mu.Lock()
+				cancelled := forwards[key] != listener
+				mu.Unlock()
+				// the master's connection dropped, taking the forward with it, so the control connection is closed
+				// for its client to redial and forward again
+				if !cancelled {
+					conn.Close()
+				}
+			}()
+		case "cancel-tcpip-forward":
+			var payload tcpipForwardPayload
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			key := net.JoinHostPort(payload.Addr, strconv.Itoa(int(payload.Port)))
+			mu.Lock()
+			listener, ok := forwards[key]
+			delete(forwards, key)
+			mu.Unlock()
+			if ok {
+				listener.Close()
+			}
+			req.Reply(ok, nil)
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// Asks the master's host to listen for a remote forward
+func (m *ControlMaster) listen(payload tcpipForwardPayload) (net.Listener, error) {
+	client, err := m.client.Client(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return client.Listen("tcp", net.JoinHostPort(payload.Addr, strconv.Itoa(int(payload.Port))))
+}
+
+// Describes the master to a check request, which is made on a control connection of its own
+func (m *ControlMaster) status() *controlStatusMsg {
+	m.mu.Lock()
+	clients := len(m.conns) - 1
+	m.mu.Unlock()
+	if clients < 0 {
+		clients = 0
+	}
+	return &controlStatusMsg{
+		Host:    m.host,
+		Pid:     uint32(os.Getpid()),
+		Started: uint64(m.started.Unix()),
+		Clients: uint32(clients),
+	}
+}
+
+// Opens a channel of the same type on the master's connection and relays data and requests between it and the
+// control connection's channel until either is closed
+func (m *ControlMaster) relayChannel(newChannel ssh.NewChannel) {
+	client, err := m.client.Client(context.Background())
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	remote, remoteRequests, err := client.OpenChannel(newChannel.ChannelType(), newChannel.ExtraData())
+	if err != nil {
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			newChannel.Reject(openErr.Reason, openErr.Message)
+		} else {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		}
+		return
+	}
+	local, localRequests, err := newChannel.Accept()
+	if err != nil {
+		remote.Close()
+		return
+	}
+	defer local.Close()
+	defer remote.Close()
+
+	// held while a request from the control connection is relayed, so that the channel is not closed before the reply
+	// is sent back, such as that of the exec which started a command which has already exited
+	var replying sync.Mutex
+	go func() {
+		relayRequests(remote, localRequests, &replying)
+		// the control connection closed its channel
+		remote.Close()
+	}()
+	go func() {
+		io.Copy(remote, local)
+		remote.CloseWrite()
+	}()
+	var output sync.WaitGroup
+	output.Add(2)
+	go func() {
+		defer output.Done()
+		io.Copy(local, remote)
+	}()
+	go func() {
+		defer output.Done()
+		io.Copy(local.Stderr(), remote.Stderr())
+	}()
+	// requests from the host, such as exit-status, are relayed until it closes the channel, and the channel is only
+	// closed locally once all of its output has been relayed
+	relayRequests(local, remoteRequests, nil)
+	output.Wait()
+	replying.Lock()
+	defer replying.Unlock()
+	local.CloseWrite()
+}
+
+// Sends each request on channel, replying to the request with channel's reply. replying, if not nil, is held while
+// each request is relayed
+func relayRequests(channel ssh.Channel, requests <-chan *ssh.Request, replying *sync.Mutex) {
+	for req := range requests {
+		if replying != nil {
+			replying.Lock()
+		}
+		ok, err := channel.SendRequest(req.Type, req.WantReply, req.Payload)
+		req.Reply(ok && err == nil, nil)
+		if replying != nil {
+			replying.Unlock()
+		}
+	}
+}
+
+// Connects to the control master listening on path. The returned client can be used like a connection to the
+// master's host
+func DialControl(path string) (*ssh.Client, error) {
+	return DialControlContext(context.Background(), path)
+}
+
+// Connects to a control master like DialControl, giving up if ctx is done first
+func DialControlContext(ctx context.Context, path string) (*ssh.Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// only the current user can open the socket, so the master's host key is not verified
+	config := &ssh.ClientConfig{User: CurrentUser, HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+	return newClientContext(ctx, conn, path, config)
+}
+
+// Returns the status of the control master listening on path
+func CheckControl(path string) (*ControlStatus, error) {
+	client, err := DialControl(path)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	ok, payload, err := client.SendRequest(controlCheckRequest, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	var msg controlStatusMsg
+	if !ok || ssh.Unmarshal(payload, &msg) != nil {
+		return nil, NotAControlMaster
+	}
+	return &ControlStatus{
+		Path:    path,
+		Host:    msg.Host,
+		Pid:     int(msg.Pid),
+		Started: time.Unix(int64(msg.Started), 0),
+		Clients: int(msg.Clients),
+	}, nil
+}
+
+// Stops the control master listening on path, closing its connection and every control connection using it
+func StopControl(path string) error {
+	client, err := DialControl(path)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	ok, _, err := client.SendRequest(controlStopRequest, true, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return NotAControlMaster
+	}
+	return nil
+}
+
+// Returns the status of each control master with a socket in dir. Sockets which no master answers on are skipped
+func ListControls(dir string) ([]*ControlStatus, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var masters []*ControlStatus
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSocket == 0 {
+			continue
+		}
+		if status, err := CheckControl(filepath.Join(dir, entry.Name())); err == nil {
+			masters = append(masters, status)
+		}
+	}
+	return masters, nil
+}
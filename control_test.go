@@ -0,0 +1,199 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestControlMaster(t *testing.T) {
+	Convey("Given a control master connected to an ssh server", t, func() {
+		server, err := startTestServer(newTestPublicKeyServer())
+		So(err, ShouldBeNil)
+		dir, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+		_, port := splitTestAddr(server.Addr())
+		config, err := loadTestSshConfig(dir, port)
+		So(err, ShouldBeNil)
+		host, err := config.Resolve("test")
+		So(err, ShouldBeNil)
+		host.ControlPath = host.expandPath(filepath.Join(dir, "control", "%C"))
+		master, err := NewControlMaster(host)
+		So(err, ShouldBeNil)
+		served := make(chan error, 1)
+		go func() {
+			served <- master.Serve()
+		}()
+
+		Convey("The socket should only be accessible to the current user", func() {
+			info, err := os.Stat(host.ControlPath)
+			So(err, ShouldBeNil)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+
+			conn, err := net.Dial("unix", host.ControlPath)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			So(checkControlPeer(conn), ShouldBeNil)
+		})
+
+		Convey("A socket should not be created in a directory others can write to", func() {
+			shared := filepath.Join(dir, "shared")
+			So(os.Mkdir(shared, 0700), ShouldBeNil)
+			So(os.Chmod(shared, 0777), ShouldBeNil)
+			_, err := listenControl(filepath.Join(shared, "control"))
+			So(err, ShouldEqual, ControlDirInsecure)
+		})
+
+		Convey("Sessions should be relayed with their output and exit status", func() {
+			client, err := DialControl(host.ControlPath)
+			So(err, ShouldBeNil)
+			defer client.Close()
+			session, err := client.NewSession()
+			So(err, ShouldBeNil)
+			output, err := session.Output("echo relayed")
+			So(err, ShouldBeNil)
+			So(string(output), ShouldEqual, "relayed\n")
+
+			session, err = client.NewSession()
+			So(err, ShouldBeNil)
+			err = session.Run("exit 3")
+			exitErr, ok := err.(*ssh.ExitError)
+			So(ok, ShouldBeTrue)
+			So(exitErr.ExitStatus(), ShouldEqual, 3)
+		})
+
+		Convey("Direct-tcpip channels should be relayed", func() {
+			echo, err := startEchoServer()
+			So(err, ShouldBeNil)
+			defer echo.Close()
+			client, err := DialControl(host.ControlPath)
+			So(err, ShouldBeNil)
+			defer client.Close()
+			conn, err := client.Dial("tcp", echo.Addr().String())
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			_, err = conn.Write([]byte("ping"))
+			So(err, ShouldBeNil)
+			reply := make([]byte, 4)
+			_, err = conn.Read(reply)
+			So(err, ShouldBeNil)
+			So(string(reply), ShouldEqual, "ping")
+		})
+
+		Convey("Remote forwards should be relayed", func() {
+			echo, err := startEchoServer()
+			So(err, ShouldBeNil)
+			defer echo.Close()
+			free, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			remoteAddr := free.Addr().String()
+			free.Close()
+
+			// with the server no longer accepting connections, only the master's connection can reach it
+			server.Close()
+			managed, err := host.DialManaged()
+			So(err, ShouldBeNil)
+			defer managed.Close()
+			go managed.StartReverseForward(remoteAddr, echo.Addr().String())
+
+			var conn net.Conn
+			for i := 0; i < 50; i++ {
+				if conn, err = net.Dial("tcp", remoteAddr); err == nil {
+					break
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			_, err = conn.Write([]byte("ping"))
+			So(err, ShouldBeNil)
+			reply := make([]byte, 4)
+			_, err = io.ReadFull(conn, reply)
+			So(err, ShouldBeNil)
+			So(string(reply), ShouldEqual, "ping")
+
+			// cancelling the forward closes the listener on the host
+			client, err := DialControl(host.ControlPath)
+			So(err, ShouldBeNil)
+			defer client.Close()
+			listener, err := client.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			So(listener.Close(), ShouldBeNil)
+			_, err = net.Dial("tcp", listener.Addr().String())
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("The host should be dialed through the master", func() {
+			// with the server no longer accepting connections, only the master's connection can reach it
+			server.Close()
+			client, err := host.Dial()
+			So(err, ShouldBeNil)
+			defer client.Close()
+			session, err := client.NewSession()
+			So(err, ShouldBeNil)
+			output, err := session.Output("echo hello")
+			So(err, ShouldBeNil)
+			So(string(output), ShouldEqual, "hello\n")
+		})
+
+		Convey("Checking and listing should describe the master", func() {
+			status, err := CheckControl(host.ControlPath)
+			So(err, ShouldBeNil)
+			So(status.Host, ShouldEqual, CurrentUser+"@"+server.Addr().String())
+			So(status.Pid, ShouldEqual, os.Getpid())
+			So(status.Clients, ShouldEqual, 0)
+
+			masters, err := ListControls(filepath.Dir(host.ControlPath))
+			So(err, ShouldBeNil)
+			So(masters, ShouldHaveLength, 1)
+			So(masters[0].Path, ShouldEqual, host.ControlPath)
+		})
+
+		Convey("A second master should not start on the same path", func() {
+			_, err := NewControlMaster(host)
+			So(err, ShouldEqual, ControlMasterRunning)
+		})
+
+		Convey("Stopping should close the master and remove its socket", func() {
+			So(StopControl(host.ControlPath), ShouldBeNil)
+			So(<-served, ShouldBeNil)
+			_, err := os.Stat(host.ControlPath)
+			So(os.IsNotExist(err), ShouldBeTrue)
+			_, err = CheckControl(host.ControlPath)
+			So(err, ShouldNotBeNil)
+		})
+
+		Reset(func() {
+			master.Close()
+			server.Close()
+			os.RemoveAll(dir)
+		})
+	})
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// deadlineConn gives a connection over an ssh channel, which does not support deadlines, the deadlines that database
+// drivers and gRPC use to time out and cancel reads and writes. Reads and writes run in the background so that they
+// can be given up on when their deadline passes, or it is moved to the past. A read given up on is finished by the
+// next, while a write given up on closes the connection, as the data it still sends can't be taken back
+type deadlineConn struct {
+	net.Conn
+	readDeadline  connDeadline
+	writeDeadline connDeadline
+
+	readMu sync.Mutex
+	// the read still running after it was given up on, and data read beyond what the caller asked for
+	pendingRead chan ioResult
+	unread      []byte
+	readErr     error
+
+	writeMu sync.Mutex
+	// set once a write has been given up on, failing every later write
+	writeErr error
+}
+
+// The outcome of a read or write
+type ioResult struct {
+	data []byte
+	err  error
+}
+
+// connDeadline is a deadline which can be changed while a read or write waits on it
+type connDeadline struct {
+	mu sync.Mutex
+	t  time.Time
+	// closed when the deadline is changed
+	changed chan struct{}
+}
+
+func newDeadlineConn(conn net.Conn) *deadlineConn {
+	return &deadlineConn{
+		Conn:          conn,
+		readDeadline:  connDeadline{changed: make(chan struct{})},
+		writeDeadline: connDeadline{changed: make(chan struct{})},
+	}
+}
+
+func (d *connDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.t = t
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// Waits for done, returning false if the deadline passes first
+func (d *connDeadline) wait(done <-chan ioResult) (ioResult, bool) {
+	for {
+		d.mu.Lock()
+		t, changed := d.t, d.changed
+		d.mu.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !t.IsZero() {
+			wait := time.Until(t)
+			if wait <= 0 {
+				// a finished read or write is still returned, as a real connection would have returned it already
+				select {
+				case result := <-done:
+					return result, true
+				default:
+					return ioResult{}, false
+				}
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case result := <-done:
+			if timer != nil {
+				timer.Stop()
+			}
+			return result, true
+		case <-timeout:
+		case <-changed:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.unread) == 0 && c.readErr == nil {
+		if c.pendingRead == nil {
+			buf := make([]byte, len(p))
+			done := make(chan ioResult, 1)
+			go func() {
+				n, err := c.Conn.Read(buf)
+				done <- ioResult{buf[:n], err}
+			}()
+			c.pendingRead = done
+		}
+		result, ok := c.readDeadline.wait(c.pendingRead)
+		if !ok {
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.pendingRead = nil
+		c.unread, c.readErr = result.data, result.err
+	}
+	n := copy(p, c.unread)
+	c.unread = c.unread[n:]
+	if len(c.unread) > 0 {
+		return n, nil
+	}
+	err := c.readErr
+	c.readErr = nil
+	return n, err
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+	// p may be reused by the caller once Write returns, even if the write is still running
+	data := append([]byte(nil), p...)
+	done := make(chan ioResult, 1)
+	go func() {
+		_, err := c.Conn.Write(data)
+		done <- ioResult{err: err}
+	}()
+	result, ok := c.writeDeadline.wait(done)
+	if !ok {
+		// the caller takes the write to have failed, so the rest of its data must not reach the other end
+		c.writeErr = os.ErrDeadlineExceeded
+		c.Conn.Close()
+		return 0, c.writeErr
+	}
+	if result.err != nil {
+		return 0, result.err
+	}
+	return len(p), nil
+}
+
+// Closes the writing side of the channel, so that the other end reads EOF
+func (c *deadlineConn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	if closeWriter, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closeWriter.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
@@ -0,0 +1,304 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The default number of hosts a FanOut works on at once
+const DefaultFanOutConcurrency = 10
+
+// errors
+var (
+	FanOutClosed = errors.New("The fan-out is closed")
+)
+
+// FanOutFunc is an operation run on one host's connection. It returns the result of the command it ran, if any
+type FanOutFunc func(ctx context.Context, conn *ssh.Client) (*Result, error)
+
+// FanOut runs the same operation on many hosts at once. Hosts behind the same jump hosts share one connection to
+// each jump host, which stays open until the FanOut is closed
+type FanOut struct {
+	// Called with each host's config once it is resolved, so that it can be adjusted, such as by command line flags
+	Configure func(h *HostConfig) error
+
+	resolver    HostResolver
+	concurrency int
+	timeout     time.Duration
+	// cancelled by Close, which stops the jump connections being dialed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// by the user@host:port of each hop in the chain reaching them
+	jumps map[string]*fanOutJump
+}
+
+// A connection to a jump host shared by the hosts behind it
+type fanOutJump struct {
+	// closed once client or err is set
+	ready  chan struct{}
+	client *ssh.Client
+	err    error
+}
+
+// HostResult is the outcome of a FanOut's operation on one host
+type HostResult struct {
+	// The host as given to the FanOut
+	Host string
+	// The result of the command run on the host, or nil if none was run
+	Result *Result
+	// Why the operation failed, or nil if it succeeded
+	Err      error
+	TimedOut bool
+	Duration time.Duration
+}
+
+// FanOutSummary groups the hosts of a FanOut's results by outcome
+type FanOutSummary struct {
+	Succeeded []string
+	Failed    []string
+	TimedOut  []string
+}
+
+// Returns a FanOut which resolves hosts with resolver, such as an SshConfig or Inventory, which may be nil to use only
+// the host names given. At most concurrency hosts (DefaultFanOutConcurrency if 0) are worked on at once, and each host
+// is given up on after timeout, or never if it is 0
+func NewFanOut(resolver HostResolver, concurrency int, timeout time.Duration) *FanOut {
+	if resolver == nil {
+		resolver = &SshConfig{}
+	}
+	if concurrency <= 0 {
+		concurrency = DefaultFanOutConcurrency
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &FanOut{
+		resolver:    resolver,
+		concurrency: concurrency,
+		timeout:     timeout,
+		ctx:         ctx,
+		cancel:      cancel,
+		jumps:       make(map[string]*fanOutJump),
+	}
+}
+
+// Runs cmd on each of hosts, returning their results in the same order
+func (f *FanOut) Run(ctx context.Context, hosts []string, cmd string) []*HostResult {
+	return f.Do(ctx, hosts, func(ctx context.Context, conn *ssh.Client) (*Result, error) {
+		return RunContext(ctx, conn, cmd)
+	})
+}
+
+// Copies the local file at filePath into destinationPath on each of hosts, returning their results in the same order
+func (f *FanOut) CopyFile(ctx context.Context, hosts []string, filePath, destinationPath string) []*HostResult {
+	return f.Do(ctx, hosts, func(ctx context.Context, conn *ssh.Client) (*Result, error) {
+		return nil, CopyFileContext(ctx, filePath, destinationPath, conn)
+	})
+}
+
+// Connects to each of hosts and runs fn on the connection, returning their results in the same order. Hosts which
+// have not been started on when ctx is done fail with its error
+func (f *FanOut) Do(ctx context.Context, hosts []string, fn FanOutFunc) []*HostResult {
+	results := make([]*HostResult, len(hosts))
+	slots := make(chan struct{}, f.concurrency)
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				results[i] = &HostResult{Host: host, Err: ctx.Err(), TimedOut: ctx.Err() == context.DeadlineExceeded}
+				return
+			}
+			defer func() {
+				<-slots
+			}()
+			results[i] = f.do(ctx, host, fn)
+		}()
+	}
+	wg.Wait()
+	f.forgetFailedJumps()
+	return results
+}
+
+// Connects to host and runs fn within the per host timeout
+func (f *FanOut) do(ctx context.Context, host string, fn FanOutFunc) *HostResult {
+	if f.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	result := &HostResult{Host: host}
+	conn, err := f.dial(ctx, host)
+	if err == nil {
+		result.Result, err = fn(ctx, conn)
+		conn.Close()
+	}
+	result.Err = err
+	result.TimedOut = errors.Is(err, context.DeadlineExceeded)
+	result.Duration = time.Since(start)
+	return result
+}
+
+// Connects to target, through the shared connections to its jump hosts
+func (f *FanOut) dial(ctx context.Context, target string) (*ssh.Client, error) {
+	h, err := f.resolver.ResolveTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	if f.Configure != nil {
+		if err := f.Configure(h); err != nil {
+			return nil, err
+		}
+	}
+	if client, err := h.dialControl(ctx); err == nil {
+		return client, nil
+	}
+	hops, err := h.Hops()
+	if err != nil {
+		return nil, err
+	}
+	last := hops[len(hops)-1]
+	if len(hops) == 1 {
+		return GetSshConnContext(ctx, last.Addr, last.Config)
+	}
+	jump, err := f.jump(ctx, hops[:len(hops)-1])
+	if err != nil {
+		return nil, err
+	}
+	return dialThrough(ctx, jump, last)
+}
+
+// Returns the shared connection to the last of hops, dialing it through the ones before it if there is none. A
+// connection which failed is not retried until the operation ends, so that the hosts behind an unreachable jump host
+// fail quickly
+func (f *FanOut) jump(ctx context.Context, hops []Hop) (*ssh.Client, error) {
+	var users []string
+	for _, hop := range hops {
+		users = append(users, hop.Config.User+"@"+hop.Addr)
+	}
+	key := strings.Join(users, ",")
+
+	f.mu.Lock()
+	if f.jumps == nil {
+		f.mu.Unlock()
+		return nil, FanOutClosed
+	}
+	j, ok := f.jumps[key]
+	if !ok {
+		j = &fanOutJump{ready: make(chan struct{})}
+		f.jumps[key] = j
+		// the jump is dialed on the FanOut's context, as it outlives the host which asked for it
+		go f.dialJump(key, j, hops)
+	}
+	f.mu.Unlock()
+
+	select {
+	case <-j.ready:
+		return j.client, j.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Dials the jump connection j to the last of hops, and forgets it once the connection drops
+func (f *FanOut) dialJump(key string, j *fanOutJump, hops []Hop) {
+	last := hops[len(hops)-1]
+	if len(hops) == 1 {
+		j.client, j.err = GetSshConnContext(f.ctx, last.Addr, last.Config)
+	} else if jump, err := f.jump(f.ctx, hops[:len(hops)-1]); err != nil {
+		j.err = err
+	} else {
+		j.client, j.err = dialThrough(f.ctx, jump, last)
+	}
+	close(j.ready)
+	if j.err != nil {
+		return
+	}
+	j.client.Wait()
+	f.mu.Lock()
+	if f.jumps != nil && f.jumps[key] == j {
+		delete(f.jumps, key)
+	}
+	f.mu.Unlock()
+}
+
+// Forgets the jump connections which could not be dialed, so that the next operation tries them again
+func (f *FanOut) forgetFailedJumps() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, j := range f.jumps {
+		select {
+		case <-j.ready:
+			if j.err != nil {
+				delete(f.jumps, key)
+			}
+		default:
+		}
+	}
+}
+
+// Closes the connections to the jump hosts
+func (f *FanOut) Close() error {
+	f.cancel()
+	f.mu.Lock()
+	jumps := f.jumps
+	f.jumps = nil
+	f.mu.Unlock()
+	for _, j := range jumps {
+		<-j.ready
+		if j.client != nil {
+			j.client.Close()
+		}
+	}
+	return nil
+}
+
+// Groups results by outcome. Timed out hosts are not also counted as failed
+func Summarize(results []*HostResult) *FanOutSummary {
+	summary := &FanOutSummary{}
+	for _, result := range results {
+		switch {
+		case result.Err == nil:
+			summary.Succeeded = append(summary.Succeeded, result.Host)
+		case result.TimedOut:
+			summary.TimedOut = append(summary.TimedOut, result.Host)
+		default:
+			summary.Failed = append(summary.Failed, result.Host)
+		}
+	}
+	return summary
+}
+
+func (s *FanOutSummary) String() string {
+	return fmt.Sprintf("%d succeeded, %d failed, %d timed out", len(s.Succeeded), len(s.Failed), len(s.TimedOut))
+}
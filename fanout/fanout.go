@@ -0,0 +1,201 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// FANOUT runs the same command on many hosts at once, or copies a file to each of them, and reports how it went on
+// every host. Hosts behind the same jump host share one connection to it. The arguments after the flags are the
+// command, joined into one command line as with ssh:
+//
+//	fanout -hosts web1,web2,web3 -J bastion -parallel 20 uptime
+//	fanout -hosts_file hosts.txt -copy app.conf -dest /etc/app
+//	fanout -inventory hosts.ini -hosts 'group:web,!web-3' uptime
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	smssh "sessionm/shared/net/ssh"
+)
+
+var (
+	hostList    = flag.String("hosts", "", "the hosts to run on, as [user@]host[:port] separated by commas. hosts may be aliases from the ssh config")
+	hostFlags   = smssh.NewHostFlags(flag.CommandLine, false)
+	hostsFile   = flag.String("hosts_file", "", "a file listing the hosts to run on, one per line. blank lines and lines starting with # are skipped")
+	copyFile    = flag.String("copy", "", "copy this local file to every host instead of running a command")
+	destination = flag.String("dest", "", "the remote directory -copy copies the file into")
+	parallel    = flag.Int("parallel", smssh.DefaultFanOutConcurrency, "the most hosts to work on at once")
+	timeout     = flag.Duration("timeout", 0, "the longest to spend on each host, including connecting, ex: 30s. 0 waits indefinitely")
+)
+
+var (
+	noHosts       = errors.New("No hosts were given (-hosts or -hosts_file)")
+	noCommand     = errors.New("No command was given, and no file to copy (-copy)")
+	noDestination = errors.New("-dest option (remote directory) is required with -copy")
+	hostsFailed   = errors.New("Some hosts did not succeed")
+)
+
+func init() {
+	flag.Lookup("inventory").Usage = "an inventory file which the hosts are looked up in. -hosts may then also select hosts from it by pattern, such as web-*, group:db or !web-3 to leave a host out"
+}
+
+func main() {
+	flag.Parse()
+	hosts, err := readHosts()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+	command := strings.Join(flag.Args(), " ")
+	if *copyFile == "" && command == "" {
+		fmt.Println(noCommand)
+		os.Exit(-1)
+	}
+	if *copyFile != "" && *destination == "" {
+		fmt.Println(noDestination)
+		os.Exit(-1)
+	}
+
+	fanOut, hosts, err := setupFanOut(hosts)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+	// interrupting fanout closes the sessions rather than leaving the command running on the hosts
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	var results []*smssh.HostResult
+	if *copyFile != "" {
+		results = fanOut.CopyFile(ctx, hosts, *copyFile, *destination)
+	} else {
+		results = fanOut.Run(ctx, hosts, command)
+	}
+	fanOut.Close()
+
+	if err := report(results); err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+}
+
+// Returns the hosts from -hosts followed by those in -hosts_file
+func readHosts() ([]string, error) {
+	var hosts []string
+	for _, host := range strings.Split(*hostList, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if *hostsFile != "" {
+		f, err := os.Open(*hostsFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				hosts = append(hosts, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, noHosts
+	}
+	return hosts, nil
+}
+
+// Returns the FanOut, and the hosts to work on, which are selected from the inventory if there is one
+func setupFanOut(hosts []string) (*smssh.FanOut, []string, error) {
+	smssh.DefaultPassphraseCallback = smssh.TerminalPassphrase
+	config, err := smssh.LoadSshConfig(hostFlags.SshConfigPaths()...)
+	if err != nil {
+		return nil, nil, err
+	}
+	var resolver smssh.HostResolver = config
+	if hostFlags.Inventory != "" {
+		inv, err := smssh.LoadInventory(hostFlags.Inventory, config)
+		if err != nil {
+			return nil, nil, err
+		}
+		if hosts, err = inv.Select(strings.Join(hosts, ",")); err != nil {
+			return nil, nil, err
+		}
+		resolver = inv
+	}
+	// flags which can't be applied are reported once rather than for every host
+	if err := hostFlags.Apply(&smssh.HostConfig{}); err != nil {
+		return nil, nil, err
+	}
+
+	fanOut := smssh.NewFanOut(resolver, *parallel, *timeout)
+	// the flags take precedence over the ssh config when given
+	fanOut.Configure = hostFlags.Apply
+	return fanOut, hosts, nil
+}
+
+// Prints each host's outcome and output, prefixing every line with the host, and then the summary
+func report(results []*smssh.HostResult) error {
+	for _, result := range results {
+		status := "ok"
+		if result.TimedOut {
+			status = "timed out"
+		} else if result.Err != nil {
+			status = "failed: " + result.Err.Error()
+		}
+		fmt.Printf("[%s] %s (%s)\n", result.Host, status, result.Duration.Round(time.Millisecond))
+		if result.Result != nil {
+			printLines(result.Host, result.Result.Stdout, os.Stdout)
+			printLines(result.Host, result.Result.Stderr, os.Stderr)
+		}
+	}
+
+	summary := smssh.Summarize(results)
+	fmt.Println(summary)
+	if len(summary.Failed) > 0 {
+		fmt.Printf("failed: %s\n", strings.Join(summary.Failed, ", "))
+	}
+	if len(summary.TimedOut) > 0 {
+		fmt.Printf("timed out: %s\n", strings.Join(summary.TimedOut, ", "))
+	}
+	if len(summary.Succeeded) < len(results) {
+		return hostsFailed
+	}
+	return nil
+}
+
+// Prints each line of output prefixed with host
+func printLines(host string, output []byte, f *os.File) {
+	if len(output) == 0 {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(output), "\n"), "\n") {
+		fmt.Fprintf(f, "%s: %s\n", host, line)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestFanOut(t *testing.T) {
+	Convey("Given ssh servers behind a jump host", t, func() {
+		signer, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+		So(err, ShouldBeNil)
+		jump := &testKeyServer{testPublicKeyServer: newTestPublicKeyServer(), accepted: signer.PublicKey()}
+		jumpListener, err := startTestServer(jump)
+		So(err, ShouldBeNil)
+		web1, err := startTestServer(newTestPublicKeyServer())
+		So(err, ShouldBeNil)
+		web2, err := startTestServer(newTestPublicKeyServer())
+		So(err, ShouldBeNil)
+		closed, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		closed.Close()
+
+		dir, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+		keyPath := filepath.Join(dir, "id_test")
+		So(ioutil.WriteFile(keyPath, []byte(testPrivateKey), 0600), ShouldBeNil)
+		var sshConfig string
+		for name, listener := range map[string]net.Addr{"jump": jumpListener.Addr(), "web1": web1.Addr(), "web2": web2.Addr(), "down": closed.Addr(), "badjump": closed.Addr()} {
+			_, port := splitTestAddr(listener)
+			sshConfig += fmt.Sprintf("Host %s\n  HostName 127.0.0.1\n  Port %d\n", name, port)
+		}
+		sshConfig += "Host web1 web2 down\n  ProxyJump jump\n"
+		sshConfig += "Host behindbad\n  HostName 127.0.0.1\n  ProxyJump badjump\n"
+		sshConfig += fmt.Sprintf("Host *\n  IdentityFile %s\n  IdentitiesOnly yes\n  StrictHostKeyChecking no\n  ControlPath none\n", keyPath)
+		configPath := filepath.Join(dir, "config")
+		So(ioutil.WriteFile(configPath, []byte(sshConfig), 0600), ShouldBeNil)
+		config, err := LoadSshConfig(configPath)
+		So(err, ShouldBeNil)
+		fanOut := NewFanOut(config, 2, 0)
+		ctx := context.Background()
+
+		Convey("Commands should run on every host over one connection to the jump host", func() {
+			results := fanOut.Run(ctx, []string{"web1", "web2", "web1", "web2"}, "echo ok")
+			So(results, ShouldHaveLength, 4)
+			for i, host := range []string{"web1", "web2", "web1", "web2"} {
+				So(results[i].Host, ShouldEqual, host)
+				So(results[i].Err, ShouldBeNil)
+				So(string(results[i].Result.Stdout), ShouldEqual, "ok\n")
+			}
+			jump.mu.Lock()
+			So(jump.offered, ShouldHaveLength, 1)
+			jump.mu.Unlock()
+			So(Summarize(results).String(), ShouldEqual, "4 succeeded, 0 failed, 0 timed out")
+		})
+
+		Convey("Failures should be reported per host", func() {
+			results := fanOut.Run(ctx, []string{"web1", "down", "behindbad"}, "echo ok")
+			So(results[0].Err, ShouldBeNil)
+			So(results[1].Err, ShouldNotBeNil)
+			So(results[2].Err, ShouldNotBeNil)
+			summary := Summarize(results)
+			So(summary.Succeeded, ShouldResemble, []string{"web1"})
+			So(summary.Failed, ShouldResemble, []string{"down", "behindbad"})
+		})
+
+		Convey("Failing commands should carry their results", func() {
+			results := fanOut.Run(ctx, []string{"web1"}, "exit 5")
+			So(results[0].Err, ShouldHaveSameTypeAs, &CommandError{})
+			So(results[0].Result.ExitStatus, ShouldEqual, 5)
+		})
+
+		Convey("Hosts should be given up on after the timeout", func() {
+			fanOut := NewFanOut(config, 2, 200*time.Millisecond)
+			defer fanOut.Close()
+			start := time.Now()
+			results := fanOut.Run(ctx, []string{"web1", "web2"}, "sleep 10")
+			So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+			summary := Summarize(results)
+			So(summary.TimedOut, ShouldResemble, []string{"web1", "web2"})
+		})
+
+		Convey("No more than the concurrency limit should run at once", func() {
+			// warm up the jump connection so that only the commands are timed
+			fanOut.Run(ctx, []string{"web1"}, "true")
+			start := time.Now()
+			results := fanOut.Run(ctx, []string{"web1", "web2", "web1", "web2"}, "sleep 0.3")
+			So(Summarize(results).Succeeded, ShouldHaveLength, 4)
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 600*time.Millisecond)
+		})
+
+		Convey("Files should be copied to every host", func() {
+			source := filepath.Join(dir, "source.txt")
+			So(ioutil.WriteFile(source, []byte("fanned out"), 0644), ShouldBeNil)
+			dest := filepath.Join(dir, "dest")
+			So(os.Mkdir(dest, 0755), ShouldBeNil)
+			results := fanOut.CopyFile(ctx, []string{"web1"}, source, dest)
+			So(results[0].Err, ShouldBeNil)
+			So(results[0].Result, ShouldBeNil)
+			data, err := ioutil.ReadFile(filepath.Join(dest, "source.txt"))
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "fanned out")
+		})
+
+		Reset(func() {
+			fanOut.Close()
+			jumpListener.Close()
+			web1.Close()
+			web2.Close()
+			os.RemoveAll(dir)
+		})
+	})
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestForwardDirectTcpip(t *testing.T) {
+	Convey("Given an in-process ssh server and an echo server behind it", t, func() {
+		_, conn := newTestConn(t)
+		echo, err := startEchoServer()
+		So(err, ShouldBeNil)
+
+		Convey("Forward a local listener over direct-tcpip channels", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			host, port := splitTestAddr(echo.Addr())
+			go Forward(conn, listener, host, port, nil, ForwardDirectTcpip)
+
+			Convey("Data written before a half-close should be echoed back in full", func() {
+				local, err := net.Dial("tcp", listener.Addr().String())
+				So(err, ShouldBeNil)
+				defer local.Close()
+				_, err = local.Write([]byte(fileData))
+				So(err, ShouldBeNil)
+				So(local.(*net.TCPConn).CloseWrite(), ShouldBeNil)
+				data, err := ioutil.ReadAll(local)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, fileData)
+			})
+
+			Reset(func() {
+				listener.Close()
+			})
+		})
+
+		Convey("Reverse forward a remote listener to the echo server", func() {
+			remote, err := conn.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			go ReverseForward(remote, echo.Addr().String())
+
+			Convey("Connections to the remote port should reach the local service", func() {
+				c, err := net.Dial("tcp", remote.Addr().String())
+				So(err, ShouldBeNil)
+				defer c.Close()
+				_, err = c.Write([]byte(fileData))
+				So(err, ShouldBeNil)
+				So(c.(*net.TCPConn).CloseWrite(), ShouldBeNil)
+				data, err := ioutil.ReadAll(c)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, fileData)
+			})
+
+			Reset(func() {
+				remote.Close()
+			})
+		})
+
+		Convey("Dialing an unreachable port should return an error", func() {
+			_, _, _, err := ForwardDirectTcpip(conn, "127.0.0.1", 1)
+			So(err, ShouldHaveSameTypeAs, &ssh.OpenChannelError{})
+		})
+
+		Reset(func() {
+			echo.Close()
+		})
+	})
+}
+
+// Starts a TCP server that echoes everything it reads and half-closes once the client has
+func startEchoServer() (net.Listener, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+				c.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+	return listener, nil
+}
+
+func splitTestAddr(addr net.Addr) (string, int) {
+	host, port, _ := net.SplitHostPort(addr.String())
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// FS is an io/fs.FS of a directory on a remote machine, read with sftp. It also implements fs.ReadDirFS and
+// fs.StatFS, so it can be used with fs.WalkDir, fs.Glob, template.ParseFS and http.FS
+type FS struct {
+	rfs  *RemoteFS
+	root string
+}
+
+// Returns an FS of the remote directory root. Relative roots are resolved against the remote user's home directory.
+// The FS should be closed once it is no longer needed, which leaves conn open
+func NewFS(conn *ssh.Client, root string) (*FS, error) {
+	rfs, err := NewRemoteFS(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &FS{rfs: rfs, root: root}, nil
+}
+
+// Ends the sftp session used by the FS
+func (f *FS) Close() error {
+	return f.rfs.Close()
+}
+
+// Returns the remote path of name, or an error if name is not a valid fs.FS path
+func (f *FS) remotePath(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return path.Join(f.root, name), nil
+}
+
+// Opens the named file or directory
+func (f *FS) Open(name string) (fs.File, error) {
+	remotePath, err := f.remotePath("open", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.rfs.Stat(remotePath)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if info.IsDir() {
+		return &remoteDir{fsys: f, name: name, info: info}, nil
+	}
+	file, err := f.rfs.Open(remotePath)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return file, nil
+}
+
+// Returns the entries of the named directory sorted by name
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	remotePath, err := f.remotePath("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := f.rfs.ReadDir(remotePath)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+// Returns information about the named file, following symbolic links
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	remotePath, err := f.remotePath("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.rfs.Stat(remotePath)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return info, nil
+}
+
+// remoteDir is an open directory of an FS. Its entries are read when they are first needed
+type remoteDir struct {
+	fsys    *FS
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *remoteDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *remoteDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *remoteDir) Close() error {
+	return nil
+}
+
+// Returns the next n entries of the directory, or all remaining entries if n <= 0, following fs.ReadDirFile
+func (d *remoteDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"os"
+	"testing"
+	"testing/fstest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFS(t *testing.T) {
+	Convey("Given an FS of a directory tree on an in-process ssh server", t, func() {
+		_, conn := newTestConn(t)
+		tree, err := createTestTree()
+		So(err, ShouldBeNil)
+		fsys, err := NewFS(conn, tree)
+		So(err, ShouldBeNil)
+
+		Convey("It should behave as an fs.FS", func() {
+			So(fstest.TestFS(fsys, "app.conf", "scratch.tmp", "conf.d/db.conf", "conf.d/keys/id"), ShouldBeNil)
+		})
+
+		Reset(func() {
+			fsys.Close()
+			os.RemoveAll(tree)
+		})
+	})
+}
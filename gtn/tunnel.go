@@ -21,8 +21,13 @@
 // GTN (or Go Tunnel) is an ssh tunneling program meant to transparently proxy a connection from a local machine to an ssh session,
 // and then to connect to an arbitrary third host. This is ideal in situations where you are behind a "jump box" such as is often
 // the case in work related environments. It does this by creating an ssh connection to the host ssh system, initiating
-// a connection to the final host, and then by listening on a local interface and port and by copying the session's
-// stdin, stdout, and stderr to the local network listener
+// a connection to the final host, and then by listening on a local interface and port and by copying data between the
+// local network listener and a direct-tcpip channel to the final host (or, with -netcat, the stdin and stdout of a
+// netcat session). With -R the direction is reversed: the ssh server listens on remote_addr:remote_port and connections
+// made to it are forwarded to a service listening on the local port, exposing that service to the remote network. With
+// -D gtn instead runs a local SOCKS proxy, connecting to whichever host each client asks for through the ssh server.
+// The ssh server may itself be behind other jump hosts, which -J connects through in turn. The ssh connection is kept
+// alive with keepalives and redialed if it drops, while the local listener stays open
 package main
 
 import (
@@ -31,15 +36,17 @@ import (
 	"fmt"
 	"os"
 	smssh "sessionm/shared/net/ssh"
-
-	"golang.org/x/crypto/ssh"
 )
 
 var (
-	sshHost       = flag.String("ssh_host", "", "the address and port of the ssh server that will be forwarding your connection")
+	sshHost       = flag.String("ssh_host", "", "the ssh server that will be forwarding your connection, as [user@]host[:port]. host may be an alias from the ssh config")
+	hostFlags     = smssh.NewHostFlags(flag.CommandLine, true)
 	remoteAddress = flag.String("remote_addr", "", "the remote address to use after connecting to the ssh tunnel ")
 	remotePort    = flag.Int("remote_port", 0, "the remote port to use after connecting to the ssh tunnel")
 	localPort     = flag.Int("local_port", 0, "the local port to listen on for incoming connections. this will be used as 127.0.0.1:{port}")
+	useNetcat     = flag.Bool("netcat", false, "forward by running netcat on the ssh server instead of opening direct-tcpip channels. requires nc on the ssh server")
+	dynamic       = flag.Bool("D", false, "dynamic mode: run a SOCKS5/SOCKS4a proxy on 127.0.0.1:{local_port} which connects to any host through the ssh server. remote_addr and remote_port are not used")
+	reverse       = flag.Bool("R", false, "reverse mode: the ssh server listens on remote_addr:remote_port and forwards connections back to 127.0.0.1:{local_port} on this machine")
 
 	// 127.0.0.1 instead of 0.0.0.0 - some programs only like mappings to 127 when forwarding is in use
 	localAddr = "127.0.0.1"
@@ -52,6 +59,10 @@ var (
 	noLocalPort     = errors.New("No local port was provided (-local_port)")
 )
 
+func init() {
+	flag.StringVar(&hostFlags.SshConfig, "ssh_config", "", "deprecated: the same as -F")
+}
+
 func main() {
 	parseFlags()
 	conn, err := setupConn()
@@ -60,7 +71,30 @@ func main() {
 		os.Exit(-1)
 	}
 
-	_, err = smssh.StartForwardedListener(conn, fmt.Sprintf("%s:%d", localAddr, *localPort), *remoteAddress, *remotePort, smssh.ForwardNetcat)
+	if *dynamic {
+		err = conn.StartSocksProxy(fmt.Sprintf("%s:%d", localAddr, *localPort))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
+		}
+		os.Exit(0)
+	}
+
+	if *reverse {
+		err = conn.StartReverseForward(fmt.Sprintf("%s:%d", *remoteAddress, *remotePort), fmt.Sprintf("%s:%d", localAddr, *localPort))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
+		}
+		os.Exit(0)
+	}
+
+	forwardFunc := smssh.ForwardDirectTcpip
+	if *useNetcat {
+		forwardFunc = smssh.ForwardNetcat
+	}
+
+	err = conn.StartForwardedListener(fmt.Sprintf("%s:%d", localAddr, *localPort), *remoteAddress, *remotePort, forwardFunc)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(-1)
@@ -74,11 +108,11 @@ func parseFlags() {
 		fmt.Println(noSshHost)
 		os.Exit(-1)
 	}
-	if *remoteAddress == "" {
+	if *remoteAddress == "" && !*dynamic {
 		fmt.Println(noRemoteAddress)
 		os.Exit(-1)
 	}
-	if *remotePort == 0 {
+	if *remotePort == 0 && !*dynamic {
 		fmt.Println(noRemotePort)
 		os.Exit(-1)
 	}
@@ -88,11 +122,12 @@ func parseFlags() {
 	}
 }
 
-func setupConn() (*ssh.Client, error) {
-
-	var config *ssh.ClientConfig
-	smssh.SetupDefaultClientConfig()
-	config = smssh.DefaultClientConfig
-
-	return smssh.GetSshConn(*sshHost, config)
+func setupConn() (*smssh.ManagedClient, error) {
+	smssh.DefaultPassphraseCallback = smssh.TerminalPassphrase
+	// the flags take precedence over the ssh config when given
+	host, err := hostFlags.Resolve(*sshHost)
+	if err != nil {
+		return nil, err
+	}
+	return host.DialManaged()
 }
@@ -0,0 +1,138 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"flag"
+	"os"
+	"time"
+)
+
+// HostFlags are the command line flags which the commands share for overriding what the ssh config says about a host
+type HostFlags struct {
+	SshConfig      string
+	Inventory      string
+	JumpHosts      string
+	ControlPath    string
+	ConnectTimeout time.Duration
+	Keepalive      time.Duration
+	KnownHosts     string
+	HostKeyPolicy  string
+	PrivateKeyFile string
+
+	fs *flag.FlagSet
+}
+
+// Registers the host flags on fs. With keepalive -keepalive is registered too, for commands which keep their
+// connection open
+func NewHostFlags(fs *flag.FlagSet, keepalive bool) *HostFlags {
+	f := &HostFlags{fs: fs}
+	fs.StringVar(&f.SshConfig, "F", "", "the ssh config file to read instead of ~/.ssh/config and /etc/ssh/ssh_config")
+	fs.StringVar(&f.Inventory, "inventory", "", "an inventory file which the remote host is looked up in, for its host name, port, user, jump hosts, identity files and host key policy. the ssh config supplies anything the inventory does not set")
+	fs.StringVar(&f.JumpHosts, "J", "", "connect to the remote host through these jump hosts, in order, as [user@]host[:port] separated by commas. overrides ProxyJump in the ssh config")
+	fs.StringVar(&f.ControlPath, "control_path", "", "the control socket of a master started with mux, which is connected through while it runs, or none to always connect directly. overrides ControlPath in the ssh config")
+	fs.DurationVar(&f.ConnectTimeout, "connect_timeout", 0, "the longest to wait for each ssh connection to be established, ex: 10s. overrides ConnectTimeout in the ssh config. 0 waits indefinitely")
+	fs.StringVar(&f.KnownHosts, "known_hosts", DefaultKnownHostsPath, "the known_hosts file used to verify the remote host's key")
+	fs.StringVar(&f.HostKeyPolicy, "host_key_policy", "strict", "how to verify the remote host's key: strict (it must be in known_hosts), tofu (add unknown hosts to known_hosts, reject changed keys) or insecure (accept any key)")
+	fs.StringVar(&f.PrivateKeyFile, "P", "", "if specified, the location of the private key file to use for the ssh session - if not provided, the IdentityFile from the ssh config or the system default paths will be attempted - id_ed25519, id_ecdsa and id_rsa in MacOS(/Users/{user}/.ssh), Linux(/home/{user}/.ssh). PEM and OpenSSH format keys are supported. keys held by a running ssh-agent (SSH_AUTH_SOCK) are always tried first")
+	if keepalive {
+		fs.DurationVar(&f.Keepalive, "keepalive", 30*time.Second, "how often to send keepalives to the remote host. the connection is redialed after 3 go unanswered or it drops. overrides ServerAliveInterval in the ssh config, which is used when this is not given")
+	}
+	return f
+}
+
+// Returns the ssh config files to read, -F if it was given and DefaultSshConfigPaths otherwise
+func (f *HostFlags) SshConfigPaths() []string {
+	if f.SshConfig != "" {
+		return []string{f.SshConfig}
+	}
+	return DefaultSshConfigPaths
+}
+
+// Resolves a [user@]host[:port] target through the inventory, if one was given, and the ssh config, and then applies
+// the flags to it
+func (f *HostFlags) Resolve(target string) (*HostConfig, error) {
+	config, err := LoadSshConfig(f.SshConfigPaths()...)
+	if err != nil {
+		return nil, err
+	}
+	var resolver HostResolver = config
+	if f.Inventory != "" {
+		if resolver, err = LoadInventory(f.Inventory, config); err != nil {
+			return nil, err
+		}
+	}
+	host, err := resolver.ResolveTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Apply(host); err != nil {
+		return nil, err
+	}
+	return host, nil
+}
+
+// Overrides the host's settings with the flags which were given
+func (f *HostFlags) Apply(host *HostConfig) error {
+	if f.ControlPath == "none" {
+		host.ControlPath = ""
+	} else if f.ControlPath != "" {
+		host.ControlPath = f.ControlPath
+	}
+	if f.JumpHosts != "" {
+		host.ProxyJump = f.JumpHosts
+	}
+	if f.ConnectTimeout > 0 {
+		host.ConnectTimeout = f.ConnectTimeout
+	}
+	// the default keepalive is used when the ssh config has none
+	if f.isSet("keepalive") || f.Keepalive > 0 && host.KeepaliveInterval == 0 {
+		host.KeepaliveInterval = f.Keepalive
+	}
+	if f.isSet("known_hosts") {
+		host.KnownHostsPath = f.KnownHosts
+	}
+	if f.isSet("host_key_policy") {
+		policy, err := ParseHostKeyPolicy(f.HostKeyPolicy)
+		if err != nil {
+			return err
+		}
+		host.HostKeyPolicy = policy
+	}
+	if f.PrivateKeyFile != "" {
+		if _, err := os.Stat(f.PrivateKeyFile); err != nil {
+			return err
+		}
+		host.IdentityFiles = []string{f.PrivateKeyFile}
+	}
+	return nil
+}
+
+// Whether a flag was given on the command line
+func (f *HostFlags) isSet(name string) bool {
+	set := false
+	f.fs.Visit(func(fl *flag.Flag) {
+		if fl.Name == name {
+			set = true
+		}
+	})
+	return set
+}
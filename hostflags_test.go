@@ -0,0 +1,117 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHostFlags(t *testing.T) {
+	Convey("Given the host flags and a host from the ssh config", t, func() {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags := NewHostFlags(fs, true)
+		host := &HostConfig{
+			ControlPath:       "/tmp/control",
+			ProxyJump:         "bastion",
+			KeepaliveInterval: time.Minute,
+			KnownHostsPath:    "/etc/ssh/known_hosts",
+			HostKeyPolicy:     HostKeyStrict,
+		}
+
+		Convey("The ssh config should be kept when no flags are given", func() {
+			So(fs.Parse(nil), ShouldBeNil)
+			So(flags.Apply(host), ShouldBeNil)
+			So(host.ControlPath, ShouldEqual, "/tmp/control")
+			So(host.ProxyJump, ShouldEqual, "bastion")
+			So(host.KeepaliveInterval, ShouldEqual, time.Minute)
+			So(host.KnownHostsPath, ShouldEqual, "/etc/ssh/known_hosts")
+			So(host.HostKeyPolicy, ShouldEqual, HostKeyStrict)
+		})
+
+		Convey("The default keepalive should be used when the ssh config has none", func() {
+			So(fs.Parse(nil), ShouldBeNil)
+			host.KeepaliveInterval = 0
+			So(flags.Apply(host), ShouldBeNil)
+			So(host.KeepaliveInterval, ShouldEqual, 30*time.Second)
+		})
+
+		Convey("The flags given should override the ssh config", func() {
+			dir, err := ioutil.TempDir("", "")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			keyPath := filepath.Join(dir, "id_ed25519")
+			So(ioutil.WriteFile(keyPath, []byte(testPrivateKey), 0600), ShouldBeNil)
+
+			So(fs.Parse([]string{"-control_path", "none", "-J", "jump1,jump2", "-connect_timeout", "5s", "-keepalive", "10s",
+				"-known_hosts", "/tmp/known_hosts", "-host_key_policy", "tofu", "-P", keyPath}), ShouldBeNil)
+			So(flags.Apply(host), ShouldBeNil)
+			So(host.ControlPath, ShouldEqual, "")
+			So(host.ProxyJump, ShouldEqual, "jump1,jump2")
+			So(host.ConnectTimeout, ShouldEqual, 5*time.Second)
+			So(host.KeepaliveInterval, ShouldEqual, 10*time.Second)
+			So(host.KnownHostsPath, ShouldEqual, "/tmp/known_hosts")
+			So(host.HostKeyPolicy, ShouldEqual, HostKeyTrustOnFirstUse)
+			So(host.IdentityFiles, ShouldResemble, []string{keyPath})
+		})
+
+		Convey("Targets should be resolved with the ssh config given, which the inventory falls back on", func() {
+			dir, err := ioutil.TempDir("", "")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			_, err = loadTestSshConfig(dir, 2022)
+			So(err, ShouldBeNil)
+			inventoryPath := filepath.Join(dir, "inventory")
+			So(ioutil.WriteFile(inventoryPath, []byte("test user=deploy\n"), 0600), ShouldBeNil)
+			defaultPaths := DefaultSshConfigPaths
+
+			So(fs.Parse([]string{"-F", filepath.Join(dir, "config")}), ShouldBeNil)
+			h, err := flags.Resolve("test")
+			So(err, ShouldBeNil)
+			So(h.HostName, ShouldEqual, "127.0.0.1")
+			So(h.Port, ShouldEqual, 2022)
+			So(h.User, ShouldEqual, CurrentUser)
+
+			flags.Inventory = inventoryPath
+			h, err = flags.Resolve("test")
+			So(err, ShouldBeNil)
+			So(h.HostName, ShouldEqual, "127.0.0.1")
+			So(h.User, ShouldEqual, "deploy")
+			So(DefaultSshConfigPaths, ShouldResemble, defaultPaths)
+		})
+
+		Convey("A bad host key policy or a missing private key should be an error", func() {
+			So(fs.Parse([]string{"-host_key_policy", "sometimes"}), ShouldBeNil)
+			So(flags.Apply(host), ShouldNotBeNil)
+
+			fs = flag.NewFlagSet("test", flag.ContinueOnError)
+			flags = NewHostFlags(fs, false)
+			So(fs.Parse([]string{"-P", "/nonexistent/id_rsa"}), ShouldBeNil)
+			So(flags.Apply(host), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,257 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyPolicy chooses how a server's host key is verified against known_hosts
+type HostKeyPolicy int
+
+const (
+	// Only hosts whose key is already in known_hosts are accepted
+	HostKeyStrict HostKeyPolicy = iota
+	// Keys of hosts that are not in known_hosts yet are accepted and added to it (trust on first use). Hosts whose key
+	// has changed are still rejected
+	HostKeyTrustOnFirstUse
+	// Every host key is accepted without checking known_hosts. This offers no protection against man in the middle
+	// attacks and should only be used for testing
+	HostKeyInsecure
+)
+
+// The names of the host key policies, as accepted by ParseHostKeyPolicy
+var hostKeyPolicyNames = map[string]HostKeyPolicy{
+	"strict":   HostKeyStrict,
+	"tofu":     HostKeyTrustOnFirstUse,
+	"insecure": HostKeyInsecure,
+}
+
+// Parses a host key policy name: "strict", "tofu" or "insecure"
+func ParseHostKeyPolicy(name string) (HostKeyPolicy, error) {
+	policy, ok := hostKeyPolicyNames[name]
+	if !ok {
+		return HostKeyStrict, fmt.Errorf("Unknown host key policy %q (expected strict, tofu or insecure)", name)
+	}
+	return policy, nil
+}
+
+// UnknownHostError is returned when a host is not in known_hosts and the policy does not allow adding it
+type UnknownHostError struct {
+	Host           string
+	Key            ssh.PublicKey
+	KnownHostsPath string
+}
+
+func (e *UnknownHostError) Error() string {
+	return fmt.Sprintf("Host %s is not in %s (%s key fingerprint %s). Connect with the trust on first use policy to add it",
+		e.Host, e.KnownHostsPath, e.Key.Type(), ssh.FingerprintSHA256(e.Key))
+}
+
+// HostKeyMismatchError is returned when a host presents a different key than the one in known_hosts
+type HostKeyMismatchError struct {
+	Host  string
+	Key   ssh.PublicKey
+	Known []knownhosts.KnownKey
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	msg := fmt.Sprintf("WARNING: the host key for %s has changed! It is now a %s key with fingerprint %s.",
+		e.Host, e.Key.Type(), ssh.FingerprintSHA256(e.Key))
+	for _, known := range e.Known {
+		msg += fmt.Sprintf(" Expected the %s key with fingerprint %s from %s:%d.",
+			known.Key.Type(), ssh.FingerprintSHA256(known.Key), known.Filename, known.Line)
+	}
+	return msg + " Someone could be intercepting the connection; if the change is expected, remove the old key from known_hosts"
+}
+
+// KnownHosts verifies host keys against an OpenSSH known_hosts file, including hashed host names and
+// @cert-authority and @revoked lines
+type KnownHosts struct {
+	path   string
+	policy HostKeyPolicy
+
+	mu       sync.Mutex
+	callback ssh.HostKeyCallback
+	// the marshalled keys of the @cert-authority lines
+	authorities map[string]bool
+}
+
+// Loads the known_hosts file at path. With the trust on first use policy the file is created if it does not exist,
+// while with the strict policy a missing file knows no hosts
+func NewKnownHosts(path string, policy HostKeyPolicy) (*KnownHosts, error) {
+	k := &KnownHosts{path: path, policy: policy}
+	if policy == HostKeyInsecure {
+		return k, nil
+	}
+	if policy == HostKeyTrustOnFirstUse {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// (Re)reads the known_hosts file. k.mu must be held, or k not yet shared
+func (k *KnownHosts) load() error {
+	callback, err := knownhosts.New(k.path)
+	if os.IsNotExist(err) {
+		// no host is known, so connecting fails with an UnknownHostError describing the host's key
+		k.callback = func(string, net.Addr, ssh.PublicKey) error {
+			return &knownhosts.KeyError{}
+		}
+		k.authorities = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+	authorities := make(map[string]bool)
+	for len(data) > 0 {
+		marker, _, key, _, rest, err := ssh.ParseKnownHosts(data)
+		if err != nil {
+			break
+		}
+		if marker == "cert-authority" {
+			authorities[string(key.Marshal())] = true
+		}
+		data = rest
+	}
+	k.callback, k.authorities = callback, authorities
+	return nil
+}
+
+// Returns an ssh.HostKeyCallback which applies the policy
+func (k *KnownHosts) HostKeyCallback() ssh.HostKeyCallback {
+	if k.policy == HostKeyInsecure {
+		return ssh.InsecureIgnoreHostKey()
+	}
+	return k.check
+}
+
+func (k *KnownHosts) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	err := k.callback(hostname, remote, key)
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return err
+	}
+	if len(keyErr.Want) > 0 {
+		return &HostKeyMismatchError{Host: hostname, Key: key, Known: keyErr.Want}
+	}
+	if k.policy != HostKeyTrustOnFirstUse {
+		return &UnknownHostError{Host: hostname, Key: key, KnownHostsPath: k.path}
+	}
+	if err := k.add(hostname, key); err != nil {
+		return err
+	}
+	return k.load()
+}
+
+// Appends a key for hostname to the known_hosts file
+func (k *KnownHosts) add(hostname string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(k.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	return err
+}
+
+// Returns the host key algorithms matching the keys known for addr, in the order they should be preferred, or nil if
+// no keys are known or addr may present a certificate. Servers usually have several host keys, so this asks them for
+// one that can be verified
+func (k *KnownHosts) HostKeyAlgorithms(addr string) []string {
+	if k.policy == HostKeyInsecure {
+		return nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	// checking a key that can't be in known_hosts lists all the keys that are
+	err := k.callback(addr, &net.TCPAddr{IP: net.IPv4zero}, unknownKey{})
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return nil
+	}
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, known := range keyErr.Want {
+		// a certificate signed by an authority may be for any type of key, so every algorithm is allowed
+		if k.authorities[string(known.Key.Marshal())] {
+			return nil
+		}
+		for _, algorithm := range keyAlgorithms(known.Key.Type()) {
+			if !seen[algorithm] {
+				seen[algorithm] = true
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	}
+	return algorithms
+}
+
+// Returns a copy of config which verifies addr's host key with this KnownHosts
+func (k *KnownHosts) ClientConfig(config *ssh.ClientConfig, addr string) *ssh.ClientConfig {
+	c := *config
+	c.HostKeyCallback = k.HostKeyCallback()
+	c.HostKeyAlgorithms = k.HostKeyAlgorithms(addr)
+	return &c
+}
+
+// Returns the signature algorithms that can be used with a key type
+func keyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+// unknownKey is a public key which never matches a key in known_hosts
+type unknownKey struct{}
+
+func (unknownKey) Type() string                        { return "unknown" }
+func (unknownKey) Marshal() []byte                     { return []byte("unknown") }
+func (unknownKey) Verify([]byte, *ssh.Signature) error { return errors.New("unknown key") }
@@ -0,0 +1,180 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testCertServer presents a host certificate signed by a test certificate authority
+type testCertServer struct {
+	*testPublicKeyServer
+	signer ssh.Signer
+}
+
+func (t *testCertServer) Signer() (ssh.Signer, error) {
+	return t.signer, nil
+}
+
+func TestKnownHosts(t *testing.T) {
+	Convey("Given an in-process ssh server and a known_hosts file", t, func() {
+		server, err := startTestServer(newTestPublicKeyServer())
+		So(err, ShouldBeNil)
+		addr := server.Addr().String()
+		hostKey, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+		So(err, ShouldBeNil)
+		config, err := testClientConfig()
+		So(err, ShouldBeNil)
+		dir, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+		path := filepath.Join(dir, "known_hosts")
+
+		connect := func(policy HostKeyPolicy) error {
+			k, err := NewKnownHosts(path, policy)
+			if err != nil {
+				return err
+			}
+			conn, err := GetSshConn(addr, k.ClientConfig(config, addr))
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}
+
+		Convey("An unknown host should be rejected with the strict policy", func() {
+			So(ioutil.WriteFile(path, nil, 0600), ShouldBeNil)
+			err := connect(HostKeyStrict)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "is not in")
+		})
+
+		Convey("Without a known_hosts file the strict policy should reject the host as unknown", func() {
+			err := connect(HostKeyStrict)
+			So(err, ShouldNotBeNil)
+			var unknown *UnknownHostError
+			So(errors.As(err, &unknown), ShouldBeTrue)
+		})
+
+		Convey("The default config should ask a host for the type of key known for it", func() {
+			_, edKey, err := ed25519.GenerateKey(rand.Reader)
+			So(err, ShouldBeNil)
+			edSigner, err := ssh.NewSignerFromKey(edKey)
+			So(err, ShouldBeNil)
+			edServer := newTestPublicKeyServer()
+			edServer.SshConfig().AddHostKey(edSigner)
+			edListener, err := startTestServer(edServer)
+			So(err, ShouldBeNil)
+			defer edListener.Close()
+			addr = edListener.Addr().String()
+			line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, edSigner.PublicKey())
+			So(ioutil.WriteFile(path, []byte(line+"\n"), 0600), ShouldBeNil)
+			keyPath := filepath.Join(dir, "id_rsa")
+			So(ioutil.WriteFile(keyPath, []byte(testPrivateKey), 0600), ShouldBeNil)
+
+			oldKeyPaths, oldKnownHosts, oldPolicy := DefaultPrivateKeyPaths, DefaultKnownHostsPath, DefaultHostKeyPolicy
+			oldConfig, oldDefaultKnownHosts := DefaultClientConfig, defaultKnownHosts
+			defer func() {
+				DefaultPrivateKeyPaths, DefaultKnownHostsPath, DefaultHostKeyPolicy = oldKeyPaths, oldKnownHosts, oldPolicy
+				DefaultClientConfig, defaultKnownHosts = oldConfig, oldDefaultKnownHosts
+			}()
+			DefaultPrivateKeyPaths = []string{keyPath}
+			DefaultKnownHostsPath = path
+			DefaultHostKeyPolicy = HostKeyStrict
+
+			So(SetupDefaultClientConfig(), ShouldBeNil)
+			conn, err := GetSshConn(addr, DefaultClientConfig)
+			So(err, ShouldBeNil)
+			conn.Close()
+		})
+
+		Convey("An unknown host should be added with the trust on first use policy", func() {
+			So(connect(HostKeyTrustOnFirstUse), ShouldBeNil)
+			So(connect(HostKeyStrict), ShouldBeNil)
+			data, err := ioutil.ReadFile(path)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostKey.PublicKey())+"\n")
+		})
+
+		Convey("A hashed entry should be accepted", func() {
+			line := knownhosts.Line([]string{knownhosts.HashHostname(knownhosts.Normalize(addr))}, hostKey.PublicKey())
+			So(ioutil.WriteFile(path, []byte(line+"\n"), 0600), ShouldBeNil)
+			So(connect(HostKeyStrict), ShouldBeNil)
+		})
+
+		Convey("A changed key should be rejected, even with the trust on first use policy", func() {
+			_, other, err := ed25519.GenerateKey(rand.Reader)
+			So(err, ShouldBeNil)
+			otherSigner, err := ssh.NewSignerFromKey(other)
+			So(err, ShouldBeNil)
+			line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, otherSigner.PublicKey())
+			So(ioutil.WriteFile(path, []byte(line+"\n"), 0600), ShouldBeNil)
+
+			k, err := NewKnownHosts(path, HostKeyTrustOnFirstUse)
+			So(err, ShouldBeNil)
+			err = k.check(addr, server.Addr(), hostKey.PublicKey())
+			So(err, ShouldHaveSameTypeAs, &HostKeyMismatchError{})
+			So(err.Error(), ShouldContainSubstring, ssh.FingerprintSHA256(otherSigner.PublicKey()))
+		})
+
+		Convey("Any host should be accepted with the insecure policy", func() {
+			So(connect(HostKeyInsecure), ShouldBeNil)
+		})
+
+		Convey("A host certificate signed by a @cert-authority should be accepted", func() {
+			_, caKey, err := ed25519.GenerateKey(rand.Reader)
+			So(err, ShouldBeNil)
+			ca, err := ssh.NewSignerFromKey(caKey)
+			So(err, ShouldBeNil)
+			cert := &ssh.Certificate{
+				Key:             hostKey.PublicKey(),
+				CertType:        ssh.HostCert,
+				ValidPrincipals: []string{"127.0.0.1"},
+				ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+			}
+			So(cert.SignCert(rand.Reader, ca), ShouldBeNil)
+			certSigner, err := ssh.NewCertSigner(cert, hostKey)
+			So(err, ShouldBeNil)
+			certServer, err := startTestServer(&testCertServer{newTestPublicKeyServer(), certSigner})
+			So(err, ShouldBeNil)
+			defer certServer.Close()
+			addr = certServer.Addr().String()
+
+			So(ioutil.WriteFile(path, []byte("@cert-authority "+knownhosts.Normalize(addr)+" "+string(ssh.MarshalAuthorizedKey(ca.PublicKey()))), 0600), ShouldBeNil)
+			So(connect(HostKeyStrict), ShouldBeNil)
+		})
+
+		Reset(func() {
+			os.RemoveAll(dir)
+			server.Close()
+		})
+	})
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHttpClient(t *testing.T) {
+	Convey("Given an ssh server and http servers behind it", t, func() {
+		_, conn := newTestConn(t)
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			fmt.Fprintf(w, "%s %s %s %s", r.Proto, r.Method, r.Header.Get("X-Test"), body)
+		})
+		web := httptest.NewServer(handler)
+		secure := httptest.NewUnstartedServer(handler)
+		secure.EnableHTTP2 = true
+		secure.StartTLS()
+
+		Convey("Requests should be made over the ssh connection", func() {
+			client := NewHttpClient(conn)
+			req, err := http.NewRequest("POST", web.URL, strings.NewReader("body"))
+			So(err, ShouldBeNil)
+			req.Header.Set("X-Test", "header")
+			resp, err := client.Do(req)
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			data, err := ioutil.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "HTTP/1.1 POST header body")
+		})
+
+		Convey("TLS should be verified, and HTTP/2 used when the server supports it", func() {
+			_, err := NewHttpClient(conn).Get(secure.URL)
+			So(err, ShouldNotBeNil)
+
+			// the TLS config is set before the transport is first used, so that it is set up for HTTP/2
+			pool := x509.NewCertPool()
+			pool.AddCert(secure.Certificate())
+			transport := NewHttpTransport(conn)
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+			resp, err := (&http.Client{Transport: transport}).Get(secure.URL)
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			data, err := ioutil.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "HTTP/2.0 GET  ")
+		})
+
+		Reset(func() {
+			web.Close()
+			secure.Close()
+		})
+	})
+}
@@ -0,0 +1,391 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The group containing every host in an inventory, whose vars apply to all of them
+const inventoryAllGroup = "all"
+
+// The settings a host or group may have in an inventory
+var inventorySettings = map[string]bool{
+	"hostname":        true,
+	"port":            true,
+	"user":            true,
+	"proxy_jump":      true,
+	"identity_file":   true,
+	"host_key_policy": true,
+}
+
+// errors
+var (
+	NoHostsMatched = errors.New("No hosts matched the pattern")
+)
+
+// Inventory lists hosts, and groups of hosts, with the settings used to connect to them. It is read from an INI-like
+// file in which each section lists the hosts of a group, one per line followed by its settings as key=value. The vars
+// section of a group holds settings for all of its hosts, and the children section of a group lists groups whose
+// hosts it also contains:
+//
+//	bastion hostname=203.0.113.10 user=jump
+//
+//	[web]
+//	web-1 hostname=10.0.0.11
+//	web-2 hostname=10.0.0.12 port=2222
+//
+//	[web:vars]
+//	user=deploy
+//	proxy_jump=bastion
+//	identity_file=~/.ssh/id_deploy
+//
+//	[prod:children]
+//	web
+//
+// The settings are hostname, port, user, proxy_jump, identity_file (comma separated) and host_key_policy. A host's
+// own settings take precedence over those of its groups, which take precedence over their parent groups' and then
+// the all group's. Hosts are also resolved with an ssh config, which supplies anything the inventory does not set
+type Inventory struct {
+	sshConfig *SshConfig
+	// in the order they first appear
+	hosts    []string
+	hostVars map[string]map[string]string
+	groups   []string
+	byName   map[string]*inventoryGroup
+}
+
+type inventoryGroup struct {
+	hosts    []string
+	children []string
+	vars     map[string]string
+}
+
+// Reads the inventory at path. Hosts are resolved with config, which may be nil to use only the inventory's settings
+func LoadInventory(path string, config *SshConfig) (*Inventory, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if config == nil {
+		config = &SshConfig{}
+	}
+	inv := &Inventory{sshConfig: config, hostVars: make(map[string]map[string]string), byName: make(map[string]*inventoryGroup)}
+
+	var group *inventoryGroup
+	var kind string
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			name := strings.TrimSuffix(line[1:], "]")
+			kind = ""
+			if i := strings.LastIndex(name, ":"); i >= 0 {
+				name, kind = name[:i], name[i+1:]
+			}
+			if !strings.HasSuffix(line, "]") || name == "" || (kind != "" && kind != "vars" && kind != "children") {
+				return nil, fmt.Errorf("Bad section %q at %s line %d", line, path, lineNumber)
+			}
+			group = inv.group(name)
+			continue
+		}
+
+		switch kind {
+		case "vars":
+			key, value, ok := strings.Cut(line, "=")
+			if err := inv.set(group.vars, key, value, ok); err != nil {
+				return nil, fmt.Errorf("%s at %s line %d", err, path, lineNumber)
+			}
+		case "children":
+			group.children = append(group.children, line)
+			inv.group(line)
+		default:
+			fields := strings.Fields(line)
+			name := fields[0]
+			vars, ok := inv.hostVars[name]
+			if !ok {
+				vars = make(map[string]string)
+				inv.hostVars[name] = vars
+				inv.hosts = append(inv.hosts, name)
+			}
+			for _, field := range fields[1:] {
+				key, value, ok := strings.Cut(field, "=")
+				if err := inv.set(vars, key, value, ok); err != nil {
+					return nil, fmt.Errorf("%s at %s line %d", err, path, lineNumber)
+				}
+			}
+			if group != nil && !containsString(group.hosts, name) {
+				group.hosts = append(group.hosts, name)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// Returns the group called name, adding it if it is new
+func (inv *Inventory) group(name string) *inventoryGroup {
+	group, ok := inv.byName[name]
+	if !ok {
+		group = &inventoryGroup{vars: make(map[string]string)}
+		inv.byName[name] = group
+		inv.groups = append(inv.groups, name)
+	}
+	return group
+}
+
+// Sets a setting parsed from key=value, where ok is whether there was an =
+func (inv *Inventory) set(vars map[string]string, key, value string, ok bool) error {
+	key = strings.TrimSpace(key)
+	if !ok {
+		return fmt.Errorf("Expected key=value, not %q", key)
+	}
+	if !inventorySettings[key] {
+		return fmt.Errorf("Unknown setting %q", key)
+	}
+	vars[key] = strings.TrimSpace(value)
+	return nil
+}
+
+// Returns the hosts matching pattern, in the order of the inventory. pattern is a comma separated list of host names,
+// host name patterns such as web-*, groups as group:name, and any of these preceded by ! to leave out their hosts.
+// Names which are not in the inventory are returned as given, after the inventory's hosts, so that other hosts can
+// be selected as well
+func (inv *Inventory) Select(pattern string) ([]string, error) {
+	included := make(map[string]bool)
+	excluded := make(map[string]bool)
+	var others []string
+	for _, p := range strings.Split(pattern, ",") {
+		p = strings.TrimSpace(p)
+		negate := strings.HasPrefix(p, "!")
+		if negate {
+			p = p[1:]
+		}
+		if p == "" {
+			continue
+		}
+		hosts, err := inv.match(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			if negate {
+				excluded[host] = true
+				continue
+			}
+			if _, ok := inv.hostVars[host]; !ok && !included[host] {
+				others = append(others, host)
+			}
+			included[host] = true
+		}
+	}
+
+	var selected []string
+	for _, host := range append(append([]string{}, inv.hosts...), others...) {
+		if included[host] && !excluded[host] {
+			selected = append(selected, host)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, NoHostsMatched
+	}
+	return selected, nil
+}
+
+// Returns the hosts matched by a single pattern
+func (inv *Inventory) match(pattern string) ([]string, error) {
+	if strings.HasPrefix(pattern, "group:") {
+		name := strings.TrimPrefix(pattern, "group:")
+		if name == inventoryAllGroup {
+			return append([]string(nil), inv.hosts...), nil
+		}
+		if _, ok := inv.byName[name]; !ok {
+			return nil, fmt.Errorf("Unknown group %q in the inventory", name)
+		}
+		return inv.groupHosts(name, make(map[string]bool)), nil
+	}
+	if !strings.ContainsAny(pattern, "*?") {
+		return []string{pattern}, nil
+	}
+	var hosts []string
+	for _, host := range inv.hosts {
+		if matchPattern(pattern, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, nil
+}
+
+// Returns the hosts of a group and of its children, skipping groups already visited
+func (inv *Inventory) groupHosts(name string, visited map[string]bool) []string {
+	if visited[name] {
+		return nil
+	}
+	visited[name] = true
+	group := inv.byName[name]
+	hosts := append([]string(nil), group.hosts...)
+	for _, child := range group.children {
+		hosts = append(hosts, inv.groupHosts(child, visited)...)
+	}
+	return hosts
+}
+
+// Returns the settings of a host, merged from the host, its groups, their parents and the all group in that order
+// of precedence
+func (inv *Inventory) settings(host string) map[string]string {
+	settings := make(map[string]string)
+	merge := func(vars map[string]string) {
+		for key, value := range vars {
+			if _, ok := settings[key]; !ok {
+				settings[key] = value
+			}
+		}
+	}
+	merge(inv.hostVars[host])
+
+	// groups are visited breadth first, from the host's own groups out to their parents
+	var queue []string
+	for _, name := range inv.groups {
+		if containsString(inv.byName[name].hosts, host) {
+			queue = append(queue, name)
+		}
+	}
+	visited := make(map[string]bool)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if visited[name] || name == inventoryAllGroup {
+			continue
+		}
+		visited[name] = true
+		merge(inv.byName[name].vars)
+		for _, parent := range inv.groups {
+			if containsString(inv.byName[parent].children, name) {
+				queue = append(queue, parent)
+			}
+		}
+	}
+	if all, ok := inv.byName[inventoryAllGroup]; ok {
+		merge(all.vars)
+	}
+	return settings
+}
+
+// Returns the configuration for host, which may be a host in the inventory or any host the ssh config resolves
+func (inv *Inventory) Resolve(host string) (*HostConfig, error) {
+	return inv.resolve(host, "")
+}
+
+// Returns the configuration for a [user@]host[:port] target. The user and port given in target take precedence over
+// the ones in the inventory
+func (inv *Inventory) ResolveTarget(target string) (*HostConfig, error) {
+	user, host, port, err := splitTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	h, err := inv.resolve(host, user)
+	if err != nil {
+		return nil, err
+	}
+	if port != 0 {
+		h.Port = port
+		h.ControlPath = h.expandPath(h.controlPath)
+	}
+	return h, nil
+}
+
+// Resolves host with the ssh config and applies the inventory's settings over it. If user is not empty it is used
+// instead of the configured user
+func (inv *Inventory) resolve(host, user string) (*HostConfig, error) {
+	settings := inv.settings(host)
+	if user == "" {
+		user = settings["user"]
+	}
+	h, err := inv.sshConfig.resolve(host, user)
+	if err != nil {
+		return nil, err
+	}
+	h.inventory = inv
+	if hostName, ok := settings["hostname"]; ok {
+		h.HostName = hostName
+	}
+	if port, ok := settings["port"]; ok {
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return nil, fmt.Errorf("Bad port %q for %s in the inventory", port, host)
+		}
+		h.Port = p
+	}
+	if jump, ok := settings["proxy_jump"]; ok {
+		h.ProxyJump = jump
+		if strings.ToLower(jump) == "none" {
+			h.ProxyJump = ""
+		}
+	}
+	if identityFiles, ok := settings["identity_file"]; ok {
+		h.IdentityFiles = nil
+		for _, identityFile := range strings.Split(identityFiles, ",") {
+			h.IdentityFiles = append(h.IdentityFiles, h.expandPath(strings.TrimSpace(identityFile)))
+		}
+	}
+	if policy, ok := settings["host_key_policy"]; ok {
+		if h.HostKeyPolicy, err = ParseHostKeyPolicy(policy); err != nil {
+			return nil, err
+		}
+	}
+	// the control path may depend on the host name and port set by the inventory
+	h.ControlPath = h.expandPath(h.controlPath)
+	return h, nil
+}
+
+// Resolves a [user@]host[:port] target using the inventory at path and the ssh_config files at DefaultSshConfigPaths
+func ResolveInventoryHost(path, target string) (*HostConfig, error) {
+	config, err := LoadSshConfig(DefaultSshConfigPaths...)
+	if err != nil {
+		return nil, err
+	}
+	inv, err := LoadInventory(path, config)
+	if err != nil {
+		return nil, err
+	}
+	return inv.ResolveTarget(target)
+}
+
+// Whether s is one of strs
+func containsString(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+const testInventory = `# hosts outside any group
+bastion hostname=203.0.113.10 user=jump
+
+[web]
+web-1 hostname=10.0.0.11
+web-2 hostname=10.0.0.12 port=2222 user=admin
+
+[web:vars]
+user=deploy
+proxy_jump=bastion
+
+[db]
+db-1 hostname=10.0.1.11
+
+[prod:children]
+web
+db
+
+[prod:vars]
+user=ops
+identity_file=~/.ssh/id_prod, ~/.ssh/id_backup
+proxy_jump=bastion
+
+[all:vars]
+port=2200
+host_key_policy=insecure
+`
+
+func TestInventory(t *testing.T) {
+	Convey("Given an inventory", t, func() {
+		dir, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+		path := filepath.Join(dir, "inventory")
+		So(ioutil.WriteFile(path, []byte(testInventory), 0600), ShouldBeNil)
+		inv, err := LoadInventory(path, nil)
+		So(err, ShouldBeNil)
+
+		Convey("Hosts should be selected by name, pattern and group in inventory order", func() {
+			hosts, err := inv.Select("web-*")
+			So(err, ShouldBeNil)
+			So(hosts, ShouldResemble, []string{"web-1", "web-2"})
+			hosts, err = inv.Select("group:prod")
+			So(err, ShouldBeNil)
+			So(hosts, ShouldResemble, []string{"web-1", "web-2", "db-1"})
+			hosts, err = inv.Select("db-1, bastion")
+			So(err, ShouldBeNil)
+			So(hosts, ShouldResemble, []string{"bastion", "db-1"})
+			hosts, err = inv.Select("group:all,!group:web")
+			So(err, ShouldBeNil)
+			So(hosts, ShouldResemble, []string{"bastion", "db-1"})
+		})
+
+		Convey("Matching hosts should not share the inventory's own lists", func() {
+			hosts, err := inv.match("group:all")
+			So(err, ShouldBeNil)
+			hosts[0] = "changed"
+			hosts, err = inv.match("group:web")
+			So(err, ShouldBeNil)
+			hosts[0] = "changed"
+			hosts, err = inv.Select("group:all")
+			So(err, ShouldBeNil)
+			So(hosts, ShouldResemble, []string{"bastion", "web-1", "web-2", "db-1"})
+			So(inv.byName["web"].hosts, ShouldResemble, []string{"web-1", "web-2"})
+		})
+
+		Convey("Hosts not in the inventory should be selected as given", func() {
+			hosts, err := inv.Select("other,web-1,admin@db-1")
+			So(err, ShouldBeNil)
+			So(hosts, ShouldResemble, []string{"web-1", "other", "admin@db-1"})
+		})
+
+		Convey("Selecting nothing or an unknown group should fail", func() {
+			_, err := inv.Select("app-*")
+			So(err, ShouldEqual, NoHostsMatched)
+			_, err = inv.Select("group:app")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A host's settings should take precedence over its groups', then their parents' and all's", func() {
+			h, err := inv.Resolve("web-1")
+			So(err, ShouldBeNil)
+			So(h.HostName, ShouldEqual, "10.0.0.11")
+			So(h.User, ShouldEqual, "deploy")
+			So(h.Port, ShouldEqual, 2200)
+			So(h.ProxyJump, ShouldEqual, "bastion")
+			So(h.HostKeyPolicy, ShouldEqual, HostKeyInsecure)
+			So(h.IdentityFiles, ShouldResemble, []string{expandHome("~/.ssh/id_prod"), expandHome("~/.ssh/id_backup")})
+
+			h, err = inv.Resolve("web-2")
+			So(err, ShouldBeNil)
+			So(h.User, ShouldEqual, "admin")
+			So(h.Port, ShouldEqual, 2222)
+
+			h, err = inv.Resolve("db-1")
+			So(err, ShouldBeNil)
+			So(h.User, ShouldEqual, "ops")
+		})
+
+		Convey("A target's user and port should take precedence over the inventory", func() {
+			h, err := inv.ResolveTarget("root@web-2:22")
+			So(err, ShouldBeNil)
+			So(h.User, ShouldEqual, "root")
+			So(h.Port, ShouldEqual, 22)
+			So(h.Addr(), ShouldEqual, "10.0.0.12:22")
+		})
+
+		Convey("Unknown settings and malformed lines should be reported with their line", func() {
+			So(ioutil.WriteFile(path, []byte("[web]\nweb-1 hostname=10.0.0.11\nweb-2 colour=blue\n"), 0600), ShouldBeNil)
+			_, err := LoadInventory(path, nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "line 3")
+			So(ioutil.WriteFile(path, []byte("[web:hosts]\n"), 0600), ShouldBeNil)
+			_, err = LoadInventory(path, nil)
+			So(err, ShouldNotBeNil)
+		})
+
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+	})
+
+	Convey("Given hosts behind a jump host listed in an inventory", t, func() {
+		signer, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+		So(err, ShouldBeNil)
+		jump := &testKeyServer{testPublicKeyServer: newTestPublicKeyServer(), accepted: signer.PublicKey()}
+		jumpListener, err := startTestServer(jump)
+		So(err, ShouldBeNil)
+		web, err := startTestServer(newTestPublicKeyServer())
+		So(err, ShouldBeNil)
+
+		dir, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+		keyPath := filepath.Join(dir, "id_test")
+		So(ioutil.WriteFile(keyPath, []byte(testPrivateKey), 0600), ShouldBeNil)
+		configPath := filepath.Join(dir, "config")
+		So(ioutil.WriteFile(configPath, []byte("Host *\n  IdentitiesOnly yes\n  ControlPath none\n"), 0600), ShouldBeNil)
+		config, err := LoadSshConfig(configPath)
+		So(err, ShouldBeNil)
+		_, jumpPort := splitTestAddr(jumpListener.Addr())
+		_, webPort := splitTestAddr(web.Addr())
+		inventory := fmt.Sprintf("bastion port=%d\n\n[web]\nweb-1 port=%d\n\n[web:vars]\nproxy_jump=bastion\n\n[all:vars]\nhostname=127.0.0.1\nidentity_file=%s\nhost_key_policy=insecure\n", jumpPort, webPort, keyPath)
+		path := filepath.Join(dir, "inventory")
+		So(ioutil.WriteFile(path, []byte(inventory), 0600), ShouldBeNil)
+		inv, err := LoadInventory(path, config)
+		So(err, ShouldBeNil)
+
+		Convey("Hosts should be dialed with the inventory's settings, through jump hosts it names", func() {
+			h, err := inv.Resolve("web-1")
+			So(err, ShouldBeNil)
+			conn, err := h.Dial()
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			result, err := Run(conn, "echo ok")
+			So(err, ShouldBeNil)
+			So(string(result.Stdout), ShouldEqual, "ok\n")
+			jump.mu.Lock()
+			So(jump.offered, ShouldHaveLength, 1)
+			jump.mu.Unlock()
+		})
+
+		Convey("A FanOut should select and resolve hosts with the inventory", func() {
+			hosts, err := inv.Select("group:web")
+			So(err, ShouldBeNil)
+			fanOut := NewFanOut(inv, 2, 0)
+			defer fanOut.Close()
+			results := fanOut.Run(context.Background(), hosts, "echo ok")
+			So(results, ShouldHaveLength, 1)
+			So(results[0].Err, ShouldBeNil)
+			So(strings.TrimSpace(string(results[0].Result.Stdout)), ShouldEqual, "ok")
+		})
+
+		Reset(func() {
+			jumpListener.Close()
+			web.Close()
+			os.RemoveAll(dir)
+		})
+	})
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The maximum number of jump hosts in a chain, which also stops ProxyJump loops in ssh_config
+const maxJumpHosts = 16
+
+// errors
+var (
+	NoHops          = errors.New("No hosts to connect to")
+	TooManyJumpHops = errors.New("Too many jump hosts (is there a ProxyJump loop in the ssh config?)")
+)
+
+// Hop is one host in a chain of ssh connections, with the config used to authenticate to it and verify its host key
+type Hop struct {
+	Addr   string
+	Config *ssh.ClientConfig
+}
+
+// Connects to the last of hops through the ones before it, in order, each connection being made over a direct-tcpip
+// channel of the previous one. Closing the returned client also closes the connections to the jump hosts
+func DialChain(hops ...Hop) (*ssh.Client, error) {
+	return DialChainContext(context.Background(), hops...)
+}
+
+// Connects through hops like DialChain, giving up if ctx is done first. The Timeout of each hop's config limits
+// connecting to and the handshake with that hop
+func DialChainContext(ctx context.Context, hops ...Hop) (*ssh.Client, error) {
+	if len(hops) == 0 {
+		return nil, NoHops
+	}
+	client, err := GetSshConnContext(ctx, hops[0].Addr, hops[0].Config)
+	if err != nil {
+		return nil, err
+	}
+	var jumps []*ssh.Client
+	for _, hop := range hops[1:] {
+		jumps = append(jumps, client)
+		if client, err = dialThrough(ctx, client, hop); err != nil {
+			closeClients(jumps)
+			return nil, err
+		}
+	}
+	if len(jumps) > 0 {
+		go func() {
+			client.Wait()
+			closeClients(jumps)
+		}()
+	}
+	return client, nil
+}
+
+// Makes an ssh connection to hop over a direct-tcpip channel of jump
+func dialThrough(ctx context.Context, jump *ssh.Client, hop Hop) (*ssh.Client, error) {
+	if hop.Config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hop.Config.Timeout)
+		defer cancel()
+	}
+	conn, err := jump.DialContext(ctx, "tcp", hop.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return newClientContext(ctx, conn, hop.Addr, hop.Config)
+}
+
+// Closes clients, the last one first
+func closeClients(clients []*ssh.Client) {
+	for i := len(clients) - 1; i >= 0; i-- {
+		clients[i].Close()
+	}
+}
+
+// Returns the hops to connect through to reach the host, ending with the host itself. The ProxyJump hosts are
+// resolved with the same ssh config and inventory as the host; as with ssh, only the first of them may have a
+// ProxyJump of its own
+func (h *HostConfig) Hops() ([]Hop, error) {
+	return h.hops(0)
+}
+
+func (h *HostConfig) hops(depth int) ([]Hop, error) {
+	if depth > maxJumpHosts {
+		return nil, TooManyJumpHops
+	}
+	var resolver HostResolver = h.sshConfig
+	if h.inventory != nil {
+		resolver = h.inventory
+	} else if h.sshConfig == nil {
+		resolver = &SshConfig{}
+	}
+
+	var hops []Hop
+	if h.ProxyJump != "" {
+		for i, target := range strings.Split(h.ProxyJump, ",") {
+			jump, err := resolver.ResolveTarget(strings.TrimSpace(target))
+			if err != nil {
+				return nil, err
+			}
+			if i > 0 {
+				jump.ProxyJump = ""
+			}
+			jumpHops, err := jump.hops(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			hops = append(hops, jumpHops...)
+		}
+	}
+	clientConfig, err := h.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return append(hops, Hop{Addr: h.Addr(), Config: clientConfig}), nil
+}
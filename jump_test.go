@@ -0,0 +1,147 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDialChain(t *testing.T) {
+	Convey("Given three ssh servers", t, func() {
+		signer, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+		So(err, ShouldBeNil)
+		var servers []*testKeyServer
+		var listeners []net.Listener
+		for i := 0; i < 3; i++ {
+			server := &testKeyServer{testPublicKeyServer: newTestPublicKeyServer(), accepted: signer.PublicKey()}
+			listener, err := startTestServer(server)
+			So(err, ShouldBeNil)
+			servers = append(servers, server)
+			listeners = append(listeners, listener)
+		}
+		config, err := testClientConfig()
+		So(err, ShouldBeNil)
+		var hops []Hop
+		for _, listener := range listeners {
+			hops = append(hops, Hop{Addr: listener.Addr().String(), Config: config})
+		}
+
+		Convey("The last server should be reached through the others", func() {
+			conn, err := DialChain(hops...)
+			So(err, ShouldBeNil)
+			for _, server := range servers {
+				So(server.offered, ShouldNotBeEmpty)
+			}
+			session, err := conn.NewSession()
+			So(err, ShouldBeNil)
+			out, err := session.Output("echo hello")
+			So(err, ShouldBeNil)
+			So(string(out), ShouldEqual, "hello\n")
+			So(conn.Close(), ShouldBeNil)
+		})
+
+		Convey("Each hop should verify its own host key", func() {
+			dir, err := ioutil.TempDir("", "")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			knownHostsPath := filepath.Join(dir, "known_hosts")
+			So(ioutil.WriteFile(knownHostsPath, nil, 0600), ShouldBeNil)
+			knownHosts, err := NewKnownHosts(knownHostsPath, HostKeyStrict)
+			So(err, ShouldBeNil)
+			hops[2].Config = knownHosts.ClientConfig(config, hops[2].Addr)
+
+			_, err = DialChain(hops...)
+			var unknown *UnknownHostError
+			So(errors.As(err, &unknown), ShouldBeTrue)
+			So(servers[1].offered, ShouldNotBeEmpty)
+			So(servers[2].offered, ShouldBeEmpty)
+		})
+
+		Convey("An unreachable hop should fail the chain", func() {
+			closed, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			closed.Close()
+			hops[1].Addr = closed.Addr().String()
+			_, err = DialChain(hops...)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("ProxyJump hosts from the ssh config should be dialed in order", func() {
+			dir, err := ioutil.TempDir("", "")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			keyPath := filepath.Join(dir, "id_test")
+			So(ioutil.WriteFile(keyPath, []byte(testPrivateKey), 0600), ShouldBeNil)
+			var sshConfig string
+			for i, listener := range listeners {
+				_, port := splitTestAddr(listener.Addr())
+				sshConfig += fmt.Sprintf("Host hop%d\n  HostName 127.0.0.1\n  Port %d\n", i, port)
+			}
+			sshConfig += "Host hop2\n  ProxyJump hop0,hop1\n"
+			sshConfig += fmt.Sprintf("Host *\n  IdentityFile %s\n  IdentitiesOnly yes\n  StrictHostKeyChecking no\n", keyPath)
+			configPath := filepath.Join(dir, "config")
+			So(ioutil.WriteFile(configPath, []byte(sshConfig), 0600), ShouldBeNil)
+
+			loaded, err := LoadSshConfig(configPath)
+			So(err, ShouldBeNil)
+			host, err := loaded.Resolve("hop2")
+			So(err, ShouldBeNil)
+			resolved, err := host.Hops()
+			So(err, ShouldBeNil)
+			So(len(resolved), ShouldEqual, 3)
+			for i, hop := range resolved {
+				So(hop.Addr, ShouldEqual, hops[i].Addr)
+			}
+			conn, err := host.Dial()
+			So(err, ShouldBeNil)
+			conn.Close()
+		})
+
+		Convey("A ProxyJump loop should be detected", func() {
+			dir, err := ioutil.TempDir("", "")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			configPath := filepath.Join(dir, "config")
+			So(ioutil.WriteFile(configPath, []byte("Host a\n  ProxyJump b\nHost b\n  ProxyJump a\n"), 0600), ShouldBeNil)
+			loaded, err := LoadSshConfig(configPath)
+			So(err, ShouldBeNil)
+			host, err := loaded.Resolve("a")
+			So(err, ShouldBeNil)
+			_, err = host.Hops()
+			So(err, ShouldEqual, TooManyJumpHops)
+		})
+
+		Reset(func() {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+		})
+	})
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// The number of times the passphrase of an encrypted key is asked for before giving up, as with ssh
+const passphraseAttempts = 3
+
+// errors
+var (
+	NoPassphraseCallback = errors.New("The private key is passphrase protected and no passphrase callback is set")
+	NotATerminal         = errors.New("Can't prompt for a passphrase without a terminal")
+)
+
+// PassphraseCallback returns the passphrase of the encrypted private key at keyPath
+type PassphraseCallback func(keyPath string) ([]byte, error)
+
+// The callback used to decrypt passphrase protected private keys. When nil, encrypted keys can't be used
+var DefaultPassphraseCallback PassphraseCallback
+
+// The passphrase protected keys decrypted so far, by path and contents, so that a key's passphrase is only asked for
+// once however many connections use it
+var (
+	decryptedKeysMu sync.Mutex
+	decryptedKeys   = make(map[string]*decryptedKey)
+)
+
+// decryptedKey is an encrypted key which has been decrypted, or is yet to be. mu is held while its passphrase is asked
+// for, so that connections using the key at the same time wait for the passphrase rather than each asking for it
+type decryptedKey struct {
+	mu     sync.Mutex
+	signer ssh.Signer
+}
+
+// Returns the decryptedKey for the key at keyPath with keyData
+func getDecryptedKey(keyPath string, keyData []byte) *decryptedKey {
+	cacheKey := keyPath + "\x00" + string(keyData)
+	decryptedKeysMu.Lock()
+	defer decryptedKeysMu.Unlock()
+	key, ok := decryptedKeys[cacheKey]
+	if !ok {
+		key = &decryptedKey{}
+		decryptedKeys[cacheKey] = key
+	}
+	return key
+}
+
+// A PassphraseCallback which prompts for the passphrase on the terminal
+func TerminalPassphrase(keyPath string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, NotATerminal
+	}
+	fmt.Fprintf(os.Stderr, "Enter passphrase for key '%s': ", keyPath)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return passphrase, err
+}
+
+// Parses a PEM or OpenSSH format private key file and returns an ssh.Signer. Passphrase protected keys are
+// decrypted with the passphrase returned by callback, but only once a server accepts their public key, so no
+// passphrase is asked for keys which go unused. The public key is read from the key itself for OpenSSH format keys,
+// and from keyPath + ".pub" otherwise; if neither is available the key is decrypted immediately
+func parsePrivateKeySigner(keyPath string, callback PassphraseCallback) (ssh.Signer, error) {
+	keyData, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(keyData)
+	missing, ok := err.(*ssh.PassphraseMissingError)
+	if !ok {
+		return signer, err
+	}
+	if callback == nil {
+		return nil, NoPassphraseCallback
+	}
+
+	encrypted := &encryptedSigner{
+		keyPath:  keyPath,
+		keyData:  keyData,
+		public:   missing.PublicKey,
+		callback: callback,
+		key:      getDecryptedKey(keyPath, keyData),
+	}
+	if encrypted.public == nil {
+		if pubData, err := ioutil.ReadFile(keyPath + ".pub"); err == nil {
+			encrypted.public, _, _, _, _ = ssh.ParseAuthorizedKey(pubData)
+		}
+	}
+	if encrypted.public == nil {
+		signer, err := encrypted.decrypt()
+		if err != nil {
+			return nil, err
+		}
+		encrypted.public = signer.PublicKey()
+	}
+	return encrypted, nil
+}
+
+// encryptedSigner is a passphrase protected private key which is decrypted the first time it is used to sign, unless
+// it has already been decrypted for another connection. Its passphrase is asked for with its own callback
+type encryptedSigner struct {
+	keyPath  string
+	keyData  []byte
+	public   ssh.PublicKey
+	callback PassphraseCallback
+	key      *decryptedKey
+
+	// set once decrypting has failed, so that the passphrase is only asked for again when the key is parsed again
+	mu  sync.Mutex
+	err error
+}
+
+// Asks for the passphrase and decrypts the key, allowing a few attempts for mistyped passphrases
+func (s *encryptedSigner) decrypt() (ssh.Signer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.key.mu.Lock()
+	defer s.key.mu.Unlock()
+	if s.key.signer != nil {
+		return s.key.signer, nil
+	}
+	var signer ssh.Signer
+	var err error
+	for attempt := 0; attempt < passphraseAttempts; attempt++ {
+		var passphrase []byte
+		if passphrase, err = s.callback(s.keyPath); err != nil {
+			break
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(s.keyData, passphrase)
+		if err != x509.IncorrectPasswordError {
+			break
+		}
+	}
+	if err != nil {
+		s.err = err
+		return nil, err
+	}
+	s.key.signer = signer
+	return signer, nil
+}
+
+func (s *encryptedSigner) PublicKey() ssh.PublicKey {
+	return s.public
+}
+
+func (s *encryptedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	signer, err := s.decrypt()
+	if err != nil {
+		return nil, err
+	}
+	return signer.Sign(rand, data)
+}
+
+// Implements ssh.AlgorithmSigner, which is needed to sign with RSA keys using SHA-2
+func (s *encryptedSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	signer, err := s.decrypt()
+	if err != nil {
+		return nil, err
+	}
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("%s can't sign with %s", s.keyPath, algorithm)
+	}
+	return algorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
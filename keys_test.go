@@ -0,0 +1,250 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+// Writes key to keyPath in OpenSSH format, encrypted with passphrase unless it is empty
+func writeTestKey(keyPath string, key crypto.PrivateKey, passphrase string) ssh.PublicKey {
+	var block *pem.Block
+	var err error
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(key, "")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte(passphrase))
+	}
+	So(err, ShouldBeNil)
+	So(ioutil.WriteFile(keyPath, pem.EncodeToMemory(block), 0600), ShouldBeNil)
+	signer, err := ssh.NewSignerFromKey(key)
+	So(err, ShouldBeNil)
+	return signer.PublicKey()
+}
+
+func TestPrivateKeys(t *testing.T) {
+	Convey("Given a server accepting a passphrase protected key", t, func() {
+		dir, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+		oldSocket := os.Getenv("SSH_AUTH_SOCK")
+		os.Unsetenv("SSH_AUTH_SOCK")
+
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		So(err, ShouldBeNil)
+		keyPath := filepath.Join(dir, "id_ed25519")
+		publicKey := writeTestKey(keyPath, key, "correct horse")
+
+		keyServer := &testKeyServer{testPublicKeyServer: newTestPublicKeyServer(), accepted: publicKey}
+		server, err := startTestServer(keyServer)
+		So(err, ShouldBeNil)
+
+		var prompts []string
+		passphrases := []string{"correct horse"}
+		callback := func(keyPath string) ([]byte, error) {
+			prompts = append(prompts, keyPath)
+			passphrase := passphrases[0]
+			if len(passphrases) > 1 {
+				passphrases = passphrases[1:]
+			}
+			return []byte(passphrase), nil
+		}
+		connect := func(auth ssh.AuthMethod) error {
+			config := &ssh.ClientConfig{User: CurrentUser, Auth: []ssh.AuthMethod{auth}, HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+			conn, err := GetSshConn(server.Addr().String(), config)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}
+
+		Convey("The passphrase should only be asked for once the key is used", func() {
+			auth, err := ParsePrivateKeyWithPassphrase(keyPath, callback)
+			So(err, ShouldBeNil)
+			So(prompts, ShouldBeEmpty)
+			So(connect(auth), ShouldBeNil)
+			So(prompts, ShouldResemble, []string{keyPath})
+		})
+
+		Convey("The passphrase should not be asked for if the server rejects the key", func() {
+			_, other, err := ed25519.GenerateKey(rand.Reader)
+			So(err, ShouldBeNil)
+			signer, err := ssh.NewSignerFromKey(other)
+			So(err, ShouldBeNil)
+			keyServer.accepted = signer.PublicKey()
+			auth, err := ParsePrivateKeyWithPassphrase(keyPath, callback)
+			So(err, ShouldBeNil)
+			So(connect(auth), ShouldNotBeNil)
+			So(prompts, ShouldBeEmpty)
+		})
+
+		Convey("A mistyped passphrase should be asked for again", func() {
+			passphrases = []string{"wrong", "battery staple", "correct horse"}
+			auth, err := ParsePrivateKeyWithPassphrase(keyPath, callback)
+			So(err, ShouldBeNil)
+			So(connect(auth), ShouldBeNil)
+			So(len(prompts), ShouldEqual, 3)
+		})
+
+		Convey("Authentication should fail after too many wrong passphrases", func() {
+			passphrases = []string{"wrong"}
+			auth, err := ParsePrivateKeyWithPassphrase(keyPath, callback)
+			So(err, ShouldBeNil)
+			So(connect(auth), ShouldNotBeNil)
+			So(len(prompts), ShouldEqual, passphraseAttempts)
+		})
+
+		Convey("Each caller's callback should be used until the key is decrypted, which later callers then share", func() {
+			var otherPrompts []string
+			other := func(keyPath string) ([]byte, error) {
+				otherPrompts = append(otherPrompts, keyPath)
+				return []byte("correct horse"), nil
+			}
+			_, err := ParsePrivateKeyWithPassphrase(keyPath, other)
+			So(err, ShouldBeNil)
+			auth, err := ParsePrivateKeyWithPassphrase(keyPath, callback)
+			So(err, ShouldBeNil)
+			So(connect(auth), ShouldBeNil)
+			So(prompts, ShouldResemble, []string{keyPath})
+			So(otherPrompts, ShouldBeEmpty)
+
+			auth, err = ParsePrivateKeyWithPassphrase(keyPath, other)
+			So(err, ShouldBeNil)
+			So(connect(auth), ShouldBeNil)
+			So(otherPrompts, ShouldBeEmpty)
+		})
+
+		Convey("An encrypted key can't be used without a passphrase callback", func() {
+			_, err := ParsePrivateKeyWithPassphrase(keyPath, nil)
+			So(err, ShouldEqual, NoPassphraseCallback)
+		})
+
+		Convey("An encrypted PEM key should be decrypted lazily using its .pub file", func() {
+			rawKey, err := ssh.ParseRawPrivateKey([]byte(testPrivateKey))
+			So(err, ShouldBeNil)
+			rsaKey := rawKey.(*rsa.PrivateKey)
+			block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), []byte("correct horse"), x509.PEMCipherAES256)
+			So(err, ShouldBeNil)
+			pemPath := filepath.Join(dir, "id_rsa")
+			So(ioutil.WriteFile(pemPath, pem.EncodeToMemory(block), 0600), ShouldBeNil)
+			signer, err := ssh.NewSignerFromKey(rsaKey)
+			So(err, ShouldBeNil)
+			So(ioutil.WriteFile(pemPath+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644), ShouldBeNil)
+			keyServer.accepted = signer.PublicKey()
+
+			auth, err := ParsePrivateKeyWithPassphrase(pemPath, callback)
+			So(err, ShouldBeNil)
+			So(prompts, ShouldBeEmpty)
+			So(connect(auth), ShouldBeNil)
+			So(prompts, ShouldResemble, []string{pemPath})
+		})
+
+		Convey("The default keys should be offered in order", func() {
+			ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			So(err, ShouldBeNil)
+			ecdsaPath := filepath.Join(dir, "id_ecdsa")
+			ecdsaPublicKey := writeTestKey(ecdsaPath, ecdsaKey, "")
+			keyServer.accepted = ecdsaPublicKey
+
+			oldKeyPaths, oldKnownHosts, oldPolicy, oldCallback := DefaultPrivateKeyPaths, DefaultKnownHostsPath, DefaultHostKeyPolicy, DefaultPassphraseCallback
+			defer func() {
+				DefaultPrivateKeyPaths, DefaultKnownHostsPath, DefaultHostKeyPolicy, DefaultPassphraseCallback = oldKeyPaths, oldKnownHosts, oldPolicy, oldCallback
+			}()
+			DefaultPrivateKeyPaths = []string{keyPath, ecdsaPath, filepath.Join(dir, "id_rsa")}
+			DefaultKnownHostsPath = filepath.Join(dir, "known_hosts")
+			DefaultHostKeyPolicy = HostKeyInsecure
+			DefaultPassphraseCallback = callback
+
+			So(SetupDefaultClientConfig(), ShouldBeNil)
+			So(connect(DefaultClientConfig.Auth[0]), ShouldBeNil)
+			So(len(keyServer.offered), ShouldEqual, 2)
+			So(keyServer.offered[0].Marshal(), ShouldResemble, publicKey.Marshal())
+			So(keyServer.offered[1].Marshal(), ShouldResemble, ecdsaPublicKey.Marshal())
+			So(prompts, ShouldBeEmpty)
+		})
+
+		Convey("Default keys which can't be used should be skipped, while named ones are an error", func() {
+			ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			So(err, ShouldBeNil)
+			ecdsaPath := filepath.Join(dir, "id_ecdsa")
+			keyServer.accepted = writeTestKey(ecdsaPath, ecdsaKey, "")
+			invalidPath := filepath.Join(dir, "id_rsa")
+			So(ioutil.WriteFile(invalidPath, []byte("not a key"), 0600), ShouldBeNil)
+
+			oldKeyPaths, oldKnownHosts, oldPolicy, oldCallback := DefaultPrivateKeyPaths, DefaultKnownHostsPath, DefaultHostKeyPolicy, DefaultPassphraseCallback
+			defer func() {
+				DefaultPrivateKeyPaths, DefaultKnownHostsPath, DefaultHostKeyPolicy, DefaultPassphraseCallback = oldKeyPaths, oldKnownHosts, oldPolicy, oldCallback
+			}()
+			DefaultPrivateKeyPaths = []string{keyPath, invalidPath, ecdsaPath}
+			DefaultKnownHostsPath = filepath.Join(dir, "known_hosts")
+			DefaultHostKeyPolicy = HostKeyInsecure
+			DefaultPassphraseCallback = nil
+
+			So(SetupDefaultClientConfig(), ShouldBeNil)
+			So(connect(DefaultClientConfig.Auth[0]), ShouldBeNil)
+			So(len(keyServer.offered), ShouldEqual, 1)
+
+			_, err = PublicKeyAuth(keyPath)
+			So(err, ShouldEqual, NoPassphraseCallback)
+			_, err = PublicKeyAuth(invalidPath)
+			So(err, ShouldNotBeNil)
+			_, err = (&HostConfig{IdentityFiles: []string{keyPath}, HostKeyPolicy: HostKeyInsecure}).ClientConfig()
+			So(err, ShouldEqual, NoPassphraseCallback)
+		})
+
+		Convey("Without any default key or agent the client can't be configured", func() {
+			oldKeyPaths := DefaultPrivateKeyPaths
+			defer func() { DefaultPrivateKeyPaths = oldKeyPaths }()
+			DefaultPrivateKeyPaths = []string{filepath.Join(dir, "id_missing")}
+			So(SetupDefaultClientConfig(), ShouldEqual, NoPrivateKey)
+		})
+
+		Reset(func() {
+			os.Setenv("SSH_AUTH_SOCK", oldSocket)
+			server.Close()
+			os.RemoveAll(dir)
+		})
+	})
+}
+
+func TestDefaultKeyLocations(t *testing.T) {
+	Convey("The default keys should be in the user's home directory, wherever it is", t, func() {
+		u, err := user.Current()
+		So(err, ShouldBeNil)
+		So(homeDir, ShouldEqual, u.HomeDir)
+		So(DefaultPrivateKeyPaths, ShouldContain, filepath.Join(u.HomeDir, ".ssh", "id_ed25519"))
+		So(DefaultKnownHostsPath, ShouldEqual, filepath.Join(u.HomeDir, ".ssh", "known_hosts"))
+	})
+}
@@ -0,0 +1,355 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sessionm/shared/log"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The global request sent as a keepalive. Servers reply to it, usually with a failure, which shows they are responding
+const keepaliveRequest = "keepalive@openssh.com"
+
+// The default number of keepalives which may go unanswered before a connection is considered dead, as with
+// ServerAliveCountMax in ssh
+const DefaultKeepaliveCountMax = 3
+
+// The delays between attempts to redial a lost connection, which double after each failure
+const (
+	minRedialBackoff = time.Second
+	maxRedialBackoff = time.Minute
+)
+
+// errors
+var (
+	ManagedClientClosed = errors.New("The managed ssh client is closed")
+)
+
+// DialFunc connects to an ssh server, such as (*HostConfig).DialContext
+type DialFunc func(ctx context.Context) (*ssh.Client, error)
+
+// ManagedClient holds an ssh connection open for long lived users such as tunnels. It sends keepalives to detect
+// servers that stopped responding, and redials lost connections with backoff, so that listeners forwarding through
+// it keep working across dropped connections
+type ManagedClient struct {
+	dial              DialFunc
+	keepaliveInterval time.Duration
+	keepaliveCountMax int
+	// cancelled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	client *ssh.Client
+	// closed and replaced whenever client changes
+	changed chan struct{}
+}
+
+// Connects with dial and returns a ManagedClient which keeps the connection alive. Keepalives are sent every
+// keepaliveInterval, or never if it is 0, and the connection is considered dead once keepaliveCountMax of them go
+// unanswered (DefaultKeepaliveCountMax if it is 0)
+func NewManagedClient(dial DialFunc, keepaliveInterval time.Duration, keepaliveCountMax int) (*ManagedClient, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	client, err := dial(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if keepaliveCountMax <= 0 {
+		keepaliveCountMax = DefaultKeepaliveCountMax
+	}
+	m := &ManagedClient{
+		dial:              dial,
+		keepaliveInterval: keepaliveInterval,
+		keepaliveCountMax: keepaliveCountMax,
+		ctx:               ctx,
+		cancel:            cancel,
+		changed:           make(chan struct{}),
+	}
+	m.setClient(client)
+	go m.run(client)
+	return m, nil
+}
+
+// Watches the connection and redials it whenever it is lost, until the ManagedClient is closed
+func (m *ManagedClient) run(client *ssh.Client) {
+	for {
+		m.watch(client)
+		m.mu.Lock()
+		m.client = nil
+		close(m.changed)
+		m.changed = make(chan struct{})
+		m.mu.Unlock()
+		if m.ctx.Err() != nil {
+			return
+		}
+		log.Errorf("Lost the ssh connection to %s, reconnecting", client.RemoteAddr())
+		if client = m.redial(); client == nil || !m.setClient(client) {
+			return
+		}
+		log.Infof("Reconnected to %s", client.RemoteAddr())
+	}
+}
+
+// Makes client the current connection, or closes it and returns false if the ManagedClient was closed
+func (m *ManagedClient) setClient(client *ssh.Client) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ctx.Err() != nil {
+		client.Close()
+		return false
+	}
+	m.client = client
+	close(m.changed)
+	m.changed = make(chan struct{})
+	return true
+}
+
+// Blocks until client's connection is lost or the ManagedClient is closed, sending keepalives to detect a server that
+// stopped responding. client is closed when this returns
+func (m *ManagedClient) watch(client *ssh.Client) {
+	defer client.Close()
+	keepAlive(m.ctx, client, m.keepaliveInterval, m.keepaliveCountMax)
+}
+
+// Blocks until client's connection is lost or ctx is done, sending a keepalive every interval, or never if it is 0.
+// The connection is taken to be lost once countMax keepalives go unanswered
+func keepAlive(ctx context.Context, client *ssh.Client, interval time.Duration, countMax int) {
+	lost := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(lost)
+	}()
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	replies := make(chan error, 1)
+	pending := false
+	missed := 0
+	for {
+		select {
+		case <-lost:
+			return
+		case <-ctx.Done():
+			return
+		case err := <-replies:
+			if err != nil {
+				return
+			}
+			pending, missed = false, 0
+		case <-tick:
+			// only one keepalive is outstanding at a time; every interval without its reply counts as a miss
+			if pending {
+				if missed++; missed >= countMax {
+					log.Errorf("%s did not answer %d keepalives", client.RemoteAddr(), missed)
+					return
+				}
+				continue
+			}
+			pending = true
+			go func() {
+				_, _, err := client.SendRequest(keepaliveRequest, true, nil)
+				replies <- err
+			}()
+		}
+	}
+}
+
+// Sends a keepalive on client, returning ctx's error if it is done before the keepalive is answered
+func sendKeepalive(ctx context.Context, client *ssh.Client) error {
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest(keepaliveRequest, true, nil)
+		reply <- err
+	}()
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Dials until a connection is made, waiting longer after each failure. nil is returned if the ManagedClient is
+// closed first
+func (m *ManagedClient) redial() *ssh.Client {
+	backoff := minRedialBackoff
+	for {
+		client, err := m.dial(m.ctx)
+		if err == nil {
+			return client
+		}
+		if m.ctx.Err() != nil {
+			return nil
+		}
+		log.Errorf("Could not reconnect (%s), retrying in %s", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-m.ctx.Done():
+			return nil
+		}
+		if backoff *= 2; backoff > maxRedialBackoff {
+			backoff = maxRedialBackoff
+		}
+	}
+}
+
+// Returns the current connection, waiting for it to be redialed if it was lost. The connection should not be closed
+// by the caller
+func (m *ManagedClient) Client(ctx context.Context) (*ssh.Client, error) {
+	return m.nextClient(ctx, nil)
+}
+
+// Returns the current connection if it is not old, otherwise waiting for it to be replaced
+func (m *ManagedClient) nextClient(ctx context.Context, old *ssh.Client) (*ssh.Client, error) {
+	for {
+		m.mu.Lock()
+		client, changed := m.client, m.changed
+		m.mu.Unlock()
+		if m.ctx.Err() != nil {
+			return nil, ManagedClientClosed
+		}
+		if client != nil && client != old {
+			return client, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-m.ctx.Done():
+			return nil, ManagedClientClosed
+		}
+	}
+}
+
+// Opens a connection to addr from the remote end of the current connection, so that m.Dial can be used as a
+// SocksProxy's Dial
+func (m *ManagedClient) Dial(network, addr string) (net.Conn, error) {
+	return m.DialContext(context.Background(), network, addr)
+}
+
+// Opens a connection to addr like Dial, giving up if ctx is done first. It has the signature of net.Dialer's
+// DialContext, so that it can be given to database drivers, http.Transport and the like to reach hosts in the remote
+// network without a local listener. Every connection shares the one ssh connection, and a dial which fails because it
+// was lost is retried once it is redialed. The connections support deadlines, unlike plain ssh channels
+func (m *ManagedClient) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var old *ssh.Client
+	for {
+		client, err := m.nextClient(ctx, old)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := client.DialContext(ctx, network, addr)
+		if err == nil {
+			return newDeadlineConn(conn), nil
+		}
+		// a refusal from a working connection is final, while a lost connection will be redialed
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if keepaliveErr := sendKeepalive(ctx, client); keepaliveErr == nil || ctx.Err() != nil {
+			return nil, err
+		}
+		old = client
+	}
+}
+
+// Opens a tcp connection to addr like DialContext, for dialers which are given only the address, such as those of
+// mysql.RegisterDialContext and grpc.WithContextDialer
+func (m *ManagedClient) DialTcpContext(ctx context.Context, addr string) (net.Conn, error) {
+	return m.DialContext(ctx, "tcp", addr)
+}
+
+// Closes the connection and stops redialing it
+func (m *ManagedClient) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cancel()
+	if m.client == nil {
+		return nil
+	}
+	err := m.client.Close()
+	m.client = nil
+	return err
+}
+
+// Starts a forwarded listener on url like StartForwardedListener, forwarding through whichever connection m currently
+// holds. This blocks until the listener fails
+func (m *ManagedClient) StartForwardedListener(url, remoteAddr string, port int, forwardFunc ForwardFunc) error {
+	listener, err := net.Listen("tcp", url)
+	if err != nil {
+		return err
+	}
+	log.Infof("[*] Listening on %s...\n", url)
+	return m.Forward(listener, remoteAddr, port, forwardFunc)
+}
+
+// Forwards connections accepted by listener to url:port like Forward, through whichever connection m currently holds
+// so that the listener stays open while a lost connection is redialed
+func (m *ManagedClient) Forward(listener net.Listener, url string, port int, forwardFunc ForwardFunc) error {
+	return forward(func() (*ssh.Client, error) {
+		return m.Client(context.Background())
+	}, listener, url, port, forwardFunc)
+}
+
+// Starts a SOCKS proxy listening on url like StartSocksProxy, dialing through whichever connection m currently holds.
+// This blocks until the listener fails
+func (m *ManagedClient) StartSocksProxy(url string) error {
+	listener, err := net.Listen("tcp", url)
+	if err != nil {
+		return err
+	}
+	log.Infof("[*] SOCKS proxy listening on %s...\n", url)
+	return (&SocksProxy{Dial: m.Dial}).Serve(listener)
+}
+
+// Asks the ssh server to listen on remoteAddr like StartReverseForward, listening again each time a lost connection
+// is redialed. This blocks until m is closed or the server refuses to listen
+func (m *ManagedClient) StartReverseForward(remoteAddr, localAddr string) error {
+	var old *ssh.Client
+	for {
+		client, err := m.nextClient(context.Background(), old)
+		if err != nil {
+			return err
+		}
+		old = client
+		listener, err := client.Listen("tcp", remoteAddr)
+		if err != nil {
+			// a refusal from a working connection is final, while a lost connection will be redialed
+			if sendKeepalive(m.ctx, client) == nil {
+				return err
+			}
+			continue
+		}
+		log.Infof("[*] Remote host listening on %s...\n", listener.Addr())
+		ReverseForward(listener, localAddr)
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+// testFreezingProxy relays tcp connections to addr, and can stop relaying to simulate a server that silently stopped
+// responding
+type testFreezingProxy struct {
+	net.Listener
+	addr   string
+	frozen sync.RWMutex
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startTestFreezingProxy(addr string) (*testFreezingProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &testFreezingProxy{Listener: listener, addr: addr}
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			remote, err := net.Dial("tcp", addr)
+			if err != nil {
+				c.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, c, remote)
+			p.mu.Unlock()
+			go p.relay(c, remote)
+			go p.relay(remote, c)
+		}
+	}()
+	return p, nil
+}
+
+func (p *testFreezingProxy) relay(dst, src net.Conn) {
+	defer dst.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		p.frozen.RLock()
+		p.frozen.RUnlock()
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// Drops every relayed connection, as a jump box dropping idle connections would
+func (p *testFreezingProxy) drop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
+
+func TestManagedClient(t *testing.T) {
+	Convey("Given a managed client connected through a proxy", t, func() {
+		server, err := startTestServer(newTestPublicKeyServer())
+		So(err, ShouldBeNil)
+		proxy, err := startTestFreezingProxy(server.Addr().String())
+		So(err, ShouldBeNil)
+		config, err := testClientConfig()
+		So(err, ShouldBeNil)
+
+		var dialsMu sync.Mutex
+		dials := 0
+		m, err := NewManagedClient(func(ctx context.Context) (*ssh.Client, error) {
+			dialsMu.Lock()
+			dials++
+			dialsMu.Unlock()
+			return GetSshConnContext(ctx, proxy.Addr().String(), config)
+		}, 100*time.Millisecond, 3)
+		So(err, ShouldBeNil)
+
+		echo, err := startEchoServer()
+		So(err, ShouldBeNil)
+		echoHost, echoPort := splitTestAddr(echo.Addr())
+		local, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		go m.Forward(local, echoHost, echoPort, ForwardDirectTcpip)
+
+		echoThroughForward := func() string {
+			c, err := net.Dial("tcp", local.Addr().String())
+			if err != nil {
+				return err.Error()
+			}
+			defer c.Close()
+			c.Write([]byte("ping"))
+			c.(*net.TCPConn).CloseWrite()
+			data, err := io.ReadAll(c)
+			if err != nil {
+				return err.Error()
+			}
+			return string(data)
+		}
+
+		Convey("Forwarding should keep working after the connection drops", func() {
+			So(echoThroughForward(), ShouldEqual, "ping")
+			first, err := m.Client(context.Background())
+			So(err, ShouldBeNil)
+
+			proxy.drop()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			second, err := m.nextClient(ctx, first)
+			So(err, ShouldBeNil)
+			So(second != first, ShouldBeTrue)
+			So(echoThroughForward(), ShouldEqual, "ping")
+			dialsMu.Lock()
+			So(dials, ShouldEqual, 2)
+			dialsMu.Unlock()
+		})
+
+		Convey("A server which stops answering keepalives should be redialed", func() {
+			first, err := m.Client(context.Background())
+			So(err, ShouldBeNil)
+			proxy.frozen.Lock()
+			lost := make(chan struct{})
+			go func() {
+				first.Wait()
+				close(lost)
+			}()
+			select {
+			case <-lost:
+			case <-time.After(5 * time.Second):
+			}
+			proxy.frozen.Unlock()
+			So(first.Wait(), ShouldNotBeNil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			second, err := m.nextClient(ctx, first)
+			So(err, ShouldBeNil)
+			So(second != first, ShouldBeTrue)
+			So(echoThroughForward(), ShouldEqual, "ping")
+		})
+
+		Convey("Connections dialed directly should share the connection and survive it dropping", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			echoThroughDial := func() string {
+				c, err := m.DialContext(ctx, "tcp", echo.Addr().String())
+				if err != nil {
+					return err.Error()
+				}
+				defer c.Close()
+				c.Write([]byte("ping"))
+				c.(interface{ CloseWrite() error }).CloseWrite()
+				data, err := io.ReadAll(c)
+				if err != nil {
+					return err.Error()
+				}
+				return string(data)
+			}
+			So(echoThroughDial(), ShouldEqual, "ping")
+			So(echoThroughDial(), ShouldEqual, "ping")
+			dialsMu.Lock()
+			So(dials, ShouldEqual, 1)
+			dialsMu.Unlock()
+
+			proxy.drop()
+			So(echoThroughDial(), ShouldEqual, "ping")
+			dialsMu.Lock()
+			So(dials, ShouldEqual, 2)
+			dialsMu.Unlock()
+		})
+
+		Convey("Connections dialed directly should support deadlines", func() {
+			c, err := m.DialTcpContext(context.Background(), echo.Addr().String())
+			So(err, ShouldBeNil)
+			defer c.Close()
+			buf := make([]byte, 4)
+
+			So(c.SetReadDeadline(time.Now().Add(50*time.Millisecond)), ShouldBeNil)
+			_, err = c.Read(buf)
+			So(err, ShouldNotBeNil)
+			netErr, ok := err.(net.Error)
+			So(ok, ShouldBeTrue)
+			So(netErr.Timeout(), ShouldBeTrue)
+
+			// a read given up on should still deliver its data to the next read
+			So(c.SetReadDeadline(time.Time{}), ShouldBeNil)
+			_, err = c.Write([]byte("pong"))
+			So(err, ShouldBeNil)
+			_, err = io.ReadFull(c, buf)
+			So(err, ShouldBeNil)
+			So(string(buf), ShouldEqual, "pong")
+
+			// moving the deadline to the past should interrupt a blocked read, as drivers do to cancel queries
+			readErr := make(chan error, 1)
+			go func() {
+				_, err := c.Read(buf)
+				readErr <- err
+			}()
+			time.Sleep(50 * time.Millisecond)
+			So(c.SetDeadline(time.Now()), ShouldBeNil)
+			select {
+			case err = <-readErr:
+			case <-time.After(5 * time.Second):
+				err = nil
+			}
+			So(errors.Is(err, os.ErrDeadlineExceeded), ShouldBeTrue)
+		})
+
+		Convey("A write given up on should close the connection and fail every later write", func() {
+			c, err := m.DialTcpContext(context.Background(), echo.Addr().String())
+			So(err, ShouldBeNil)
+			defer c.Close()
+
+			// nothing is read back, so the echo server and then the channel stop taking data
+			So(c.SetWriteDeadline(time.Now().Add(200*time.Millisecond)), ShouldBeNil)
+			_, err = c.Write(make([]byte, 32<<20))
+			So(errors.Is(err, os.ErrDeadlineExceeded), ShouldBeTrue)
+
+			So(c.SetWriteDeadline(time.Time{}), ShouldBeNil)
+			_, err = c.Write([]byte("ping"))
+			So(errors.Is(err, os.ErrDeadlineExceeded), ShouldBeTrue)
+			So(c.(interface{ CloseWrite() error }).CloseWrite(), ShouldNotBeNil)
+		})
+
+		Convey("Refused connections should fail without redialing", func() {
+			closed, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			closed.Close()
+			_, err = m.DialContext(context.Background(), "tcp", closed.Addr().String())
+			So(err, ShouldNotBeNil)
+			dialsMu.Lock()
+			So(dials, ShouldEqual, 1)
+			dialsMu.Unlock()
+		})
+
+		Convey("A closed managed client should not redial", func() {
+			So(m.Close(), ShouldBeNil)
+			_, err := m.Client(context.Background())
+			So(err, ShouldEqual, ManagedClientClosed)
+			_, err = m.Dial("tcp", echo.Addr().String())
+			So(err, ShouldEqual, ManagedClientClosed)
+		})
+
+		Reset(func() {
+			m.Close()
+			local.Close()
+			echo.Close()
+			proxy.Close()
+			server.Close()
+		})
+	})
+}
@@ -20,7 +20,11 @@
 
 package ssh
 
-import "golang.org/x/crypto/ssh"
+import (
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
 
 // To be very clear, this Test Private Key is only intended to be used in a TEST ENVIRONMENT and is intended to be
 // transient. Putting private keys of any other kind in source control is not a good idea.
@@ -71,6 +75,69 @@ type (
 	}
 )
 
+// Configures s and serves it on a random loopback port, with every optional feature enabled, until the returned
+// listener is closed
+func startTestServer(s SshServer) (net.Listener, error) {
+	return startTestServerWithFeatures(s, ServerFeatures{DirectTcpip: true, RemoteForward: true, Exec: true, Sftp: true})
+}
+
+// Serves s like startTestServer, with only the given features enabled
+func startTestServerWithFeatures(s SshServer, features ServerFeatures) (net.Listener, error) {
+	if err := configureServer(s); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go serveListener(s, listener, features)
+	return listener, nil
+}
+
+// testingT is the part of *testing.T used by the test helpers, so that this file need not import testing
+type testingT interface {
+	Helper()
+	Fatal(args ...interface{})
+	Cleanup(func())
+}
+
+// Starts a test server and connects to it with testClientConfig. Both are closed when the test finishes
+func newTestConn(t testingT) (net.Listener, *ssh.Client) {
+	t.Helper()
+	server, err := startTestServer(newTestPublicKeyServer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+	})
+	config, err := testClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := GetSshConn(server.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return server, conn
+}
+
+// Returns a client config that authenticates with the test private key and accepts any host key
+func testClientConfig() (*ssh.ClientConfig, error) {
+	signer, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.ClientConfig{
+		User:            CurrentUser,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}, nil
+}
+
 func newTestPublicKeyServer() *testPublicKeyServer {
 	return &testPublicKeyServer{port: testPort, networkInterface: testNetworkInterface, config: &ssh.ServerConfig{}}
 }
@@ -0,0 +1,213 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// MUX keeps an ssh connection to a host open in the background as a control master, like ssh's ControlMaster. While
+// it runs, rcurl, gtn, rsh and any other program connecting through (*HostConfig).Dial open their sessions and forwards
+// over the master's connection instead of connecting and authenticating again. The master listens on the host's
+// ControlPath from the ssh config, ~/.ssh/control/%C by default.
+//
+//	mux -H host start   start a master for host in the background
+//	mux -H host serve   run a master for host in the foreground
+//	mux -H host check   show whether a master is running for host
+//	mux -H host stop    stop the master for host
+//	mux list            list the running masters
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	smssh "sessionm/shared/net/ssh"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	sshHost   = flag.String("H", "", "the remote host to keep a connection to, as [user@]host[:port]. host may be an alias from the ssh config")
+	hostFlags = smssh.NewHostFlags(flag.CommandLine, true)
+)
+
+// Set in the environment of a master started in the background, which detaches from the terminal once it is listening
+const backgroundEnv = "MUX_BACKGROUND"
+
+var (
+	noCommand      = errors.New("A command is required: start, serve, check, stop or list")
+	noSshHost      = errors.New("-H option (remote host) is required.")
+	noControlPath  = errors.New("No control path is configured for the host (-control_path)")
+	masterExited   = errors.New("The control master exited before it was ready")
+	unknownCommand = errors.New("Unknown command, expected start, serve, check, stop or list")
+)
+
+func init() {
+	flag.Lookup("control_path").Usage = "the control socket of the master. overrides ControlPath in the ssh config. list lists the masters in this socket's directory"
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Println(noCommand)
+		os.Exit(-1)
+	}
+	var err error
+	switch flag.Arg(0) {
+	case "list":
+		err = list()
+	case "start", "serve", "check", "stop":
+		var host *smssh.HostConfig
+		if host, err = resolveHost(); err == nil {
+			err = run(flag.Arg(0), host)
+		}
+	default:
+		err = unknownCommand
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+}
+
+// Runs a command which acts on the master for host
+func run(command string, host *smssh.HostConfig) error {
+	switch command {
+	case "start":
+		return start(host)
+	case "serve":
+		return serve(host)
+	case "check":
+		status, err := smssh.CheckControl(host.ControlPath)
+		if err != nil {
+			return fmt.Errorf("No control master is running on %s: %s", host.ControlPath, err)
+		}
+		fmt.Printf("Control master for %s running on %s (pid %d, %d clients)\n", status.Host, status.Path, status.Pid, status.Clients)
+		return nil
+	case "stop":
+		if err := smssh.StopControl(host.ControlPath); err != nil {
+			return err
+		}
+		fmt.Printf("Stopped the control master on %s\n", host.ControlPath)
+		return nil
+	}
+	return unknownCommand
+}
+
+// Resolves -H through the ssh config, applying the flags which override it
+func resolveHost() (*smssh.HostConfig, error) {
+	if *sshHost == "" {
+		return nil, noSshHost
+	}
+	smssh.DefaultPassphraseCallback = smssh.TerminalPassphrase
+	// the flags take precedence over the ssh config when given
+	host, err := hostFlags.Resolve(*sshHost)
+	if err != nil {
+		return nil, err
+	}
+	if host.ControlPath == "" {
+		return nil, noControlPath
+	}
+	return host, nil
+}
+
+// Runs the master in the foreground until it is stopped
+func serve(host *smssh.HostConfig) error {
+	master, err := smssh.NewControlMaster(host)
+	if err != nil {
+		return err
+	}
+	if os.Getenv(backgroundEnv) != "" {
+		if err := detach(); err != nil {
+			master.Close()
+			return err
+		}
+	}
+	return master.Serve()
+}
+
+// Runs serve again in a new session, returning once the master is listening. The master keeps the terminal until
+// then so that passphrases can be asked for
+func start(host *smssh.HostConfig) error {
+	if _, err := smssh.CheckControl(host.ControlPath); err == nil {
+		return smssh.ControlMasterRunning
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// the flags are passed on unchanged
+	args := append(append([]string{}, os.Args[1:len(os.Args)-flag.NArg()]...), "serve")
+	cmd := exec.Command(self, args...)
+	cmd.Env = append(os.Environ(), backgroundEnv+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	for {
+		select {
+		case <-exited:
+			return masterExited
+		case <-time.After(100 * time.Millisecond):
+		}
+		if status, err := smssh.CheckControl(host.ControlPath); err == nil && status.Pid == cmd.Process.Pid {
+			fmt.Printf("Control master for %s running on %s (pid %d)\n", status.Host, status.Path, status.Pid)
+			return nil
+		}
+	}
+}
+
+// Points stdin, stdout and stderr at /dev/null, releasing the terminal
+func detach() error {
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer devNull.Close()
+	for _, f := range []*os.File{os.Stdin, os.Stdout, os.Stderr} {
+		if err := unix.Dup2(int(devNull.Fd()), int(f.Fd())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prints the masters with sockets in the control path's directory
+func list() error {
+	path := smssh.DefaultControlPath
+	if hostFlags.ControlPath != "" {
+		path = hostFlags.ControlPath
+	}
+	masters, err := smssh.ListControls(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	for _, status := range masters {
+		fmt.Printf("%d\t%s\t%s\t%d clients\t%s\n", status.Pid, status.Host, status.Started.Format(time.RFC3339), status.Clients, status.Path)
+	}
+	return nil
+}
@@ -0,0 +1,486 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The default number of sessions shared on one connection, which is sshd's default MaxSessions
+const DefaultMaxSessions = 10
+
+// How often pooled connections to hosts without a ServerAliveInterval are checked
+const DefaultPoolKeepaliveInterval = 30 * time.Second
+
+// errors
+var (
+	PoolClosed    = errors.New("The ssh connection pool is closed")
+	LeaseReleased = errors.New("The pooled ssh connection has been released")
+)
+
+// Pool shares ssh connections between operations on the same host. Connections are keyed by user and address, at
+// most maxSessions sessions and channels are open on each of them at a time (servers refuse sessions past their
+// MaxSessions), and more connections are dialed as needed. Connections which drop or stop answering keepalives are
+// evicted, and idle ones are closed
+type Pool struct {
+	config      *SshConfig
+	maxSessions int
+	idleTimeout time.Duration
+	// for hosts without a ServerAliveInterval
+	keepaliveInterval time.Duration
+
+	mu sync.Mutex
+	// by user@host:port, and by the targets given to Get
+	hosts   map[string]*poolHost
+	targets map[string]*poolHost
+	// closed and replaced whenever a connection is added, released or evicted
+	changed chan struct{}
+	closed  bool
+	stats   PoolStats
+}
+
+// The connections to one user@host:port
+type poolHost struct {
+	key               string
+	hops              []Hop
+	keepaliveInterval time.Duration
+	keepaliveCountMax int
+	conns             []*poolConn
+	// the connections being dialed, and the callers waiting for them
+	dialing int
+	waiting int
+}
+
+type poolConn struct {
+	client *ssh.Client
+	// the session slots taken by leases
+	sessions int
+	idle     *time.Timer
+	evicted  bool
+}
+
+// PoolStats is a snapshot of a Pool's connections and counters
+type PoolStats struct {
+	// The open connections by user@host:port
+	Hosts map[string]PoolHostStats
+	// The connections dialed, and the dials which failed
+	Dials        int
+	DialFailures int
+	// The connections which dropped while in the pool, and the ones closed after being idle
+	Evictions  int
+	IdleClosed int
+}
+
+// PoolHostStats describes the connections to one user@host:port
+type PoolHostStats struct {
+	Conns int
+	// The session slots in use
+	Sessions int
+}
+
+// PooledClient is a lease on a connection lent by a Pool. It holds one session slot on the connection until it is
+// released, and takes more while it has several sessions or channels open at once. It must be released when done
+// rather than closed, as the connection is shared
+type PooledClient struct {
+	pool *Pool
+	host *poolHost
+	conn *poolConn
+	// the slots held, and the sessions and channels open in them. Guarded by pool.mu
+	slots    int
+	open     int
+	released bool
+}
+
+// PooledSession is a session opened on a pooled connection, which gives its slot back when it is closed
+type PooledSession struct {
+	*ssh.Session
+	lease *PooledClient
+	once  sync.Once
+}
+
+// pooledChannel is a channel dialed on a pooled connection, which gives its slot back when it is closed
+type pooledChannel struct {
+	net.Conn
+	lease *PooledClient
+	once  sync.Once
+}
+
+// Returns a Pool which resolves hosts with config, which may be nil to use only the host names given. Connections
+// carry up to maxSessions concurrent sessions and channels (DefaultMaxSessions if 0), and are closed after being idle
+// for idleTimeout, or kept until the pool is closed if it is 0
+func NewPool(config *SshConfig, maxSessions int, idleTimeout time.Duration) *Pool {
+	if config == nil {
+		config = &SshConfig{}
+	}
+	if maxSessions <= 0 {
+		maxSessions = DefaultMaxSessions
+	}
+	return &Pool{
+		config:            config,
+		maxSessions:       maxSessions,
+		idleTimeout:       idleTimeout,
+		keepaliveInterval: DefaultPoolKeepaliveInterval,
+		hosts:             make(map[string]*poolHost),
+		targets:           make(map[string]*poolHost),
+		changed:           make(chan struct{}),
+	}
+}
+
+// Returns a connection to a [user@]host[:port] target, reusing a pooled one with a free session if there is one
+func (p *Pool) Get(ctx context.Context, target string) (*PooledClient, error) {
+	host, err := p.host(target)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if p.closed {
+			return nil, PoolClosed
+		}
+		if conn := host.available(p.maxSessions); conn != nil {
+			return p.lend(host, conn), nil
+		}
+
+		// wait for the connections already being dialed if they will have room, rather than dialing more
+		if host.waiting < host.dialing*(p.maxSessions-1) {
+			host.waiting++
+			changed := p.changed
+			p.mu.Unlock()
+			select {
+			case <-changed:
+			case <-ctx.Done():
+			}
+			p.mu.Lock()
+			host.waiting--
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		host.dialing++
+		p.stats.Dials++
+		p.mu.Unlock()
+		client, err := DialChainContext(ctx, host.hops...)
+		p.mu.Lock()
+		host.dialing--
+		p.notify()
+		if err != nil {
+			p.stats.DialFailures++
+			return nil, err
+		}
+		if p.closed {
+			client.Close()
+			return nil, PoolClosed
+		}
+		conn := &poolConn{client: client}
+		host.conns = append(host.conns, conn)
+		go p.watch(host, conn)
+		return p.lend(host, conn), nil
+	}
+}
+
+// Runs f with a pooled connection to target, releasing it afterwards
+func (p *Pool) Do(ctx context.Context, target string, f func(c *PooledClient) error) error {
+	c, err := p.Get(ctx, target)
+	if err != nil {
+		return err
+	}
+	defer c.Release()
+	return f(c)
+}
+
+// Returns the pooled host for target, resolving it the first time. The keys are loaded once, so that passphrases are
+// only asked for once
+func (p *Pool) host(target string) (*poolHost, error) {
+	p.mu.Lock()
+	host, ok := p.targets[target]
+	p.mu.Unlock()
+	if ok {
+		return host, nil
+	}
+
+	h, err := p.config.ResolveTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	key := h.User + "@" + h.Addr()
+	p.mu.Lock()
+	host, ok = p.hosts[key]
+	p.mu.Unlock()
+	if !ok {
+		hops, err := h.Hops()
+		if err != nil {
+			return nil, err
+		}
+		host = &poolHost{key: key, hops: hops, keepaliveInterval: h.KeepaliveInterval, keepaliveCountMax: h.KeepaliveCountMax}
+		if host.keepaliveInterval == 0 {
+			host.keepaliveInterval = p.keepaliveInterval
+		}
+		if host.keepaliveCountMax == 0 {
+			host.keepaliveCountMax = DefaultKeepaliveCountMax
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if existing, ok := p.hosts[key]; ok {
+		host = existing
+	} else {
+		p.hosts[key] = host
+	}
+	p.targets[target] = host
+	return host, nil
+}
+
+// Returns the least busy connection with a free session, or nil. p.mu must be held
+func (h *poolHost) available(maxSessions int) *poolConn {
+	var best *poolConn
+	for _, conn := range h.conns {
+		if conn.sessions < maxSessions && (best == nil || conn.sessions < best.sessions) {
+			best = conn
+		}
+	}
+	return best
+}
+
+// Takes a session slot on conn for a new lease. p.mu must be held
+func (p *Pool) lend(host *poolHost, conn *poolConn) *PooledClient {
+	conn.sessions++
+	if conn.idle != nil {
+		conn.idle.Stop()
+		conn.idle = nil
+	}
+	return &PooledClient{pool: p, host: host, conn: conn, slots: 1}
+}
+
+// Gives n session slots on conn back. p.mu must be held
+func (p *Pool) giveBack(host *poolHost, conn *poolConn, n int) {
+	conn.sessions -= n
+	if conn.sessions == 0 && p.idleTimeout > 0 && !p.closed && !conn.evicted {
+		conn.idle = time.AfterFunc(p.idleTimeout, func() {
+			p.closeIdle(host, conn)
+		})
+	}
+	p.notify()
+}
+
+// Wakes the callers waiting for a change. p.mu must be held
+func (p *Pool) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// Evicts conn from the pool once its connection drops or stops answering keepalives
+func (p *Pool) watch(host *poolHost, conn *poolConn) {
+	keepAlive(context.Background(), conn.client, host.keepaliveInterval, host.keepaliveCountMax)
+	conn.client.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.remove(host, conn) {
+		p.stats.Evictions++
+	}
+}
+
+// Removes conn from host's connections, returning false if it was already removed. p.mu must be held
+func (p *Pool) remove(host *poolHost, conn *poolConn) bool {
+	for i, c := range host.conns {
+		if c == conn {
+			host.conns = append(host.conns[:i], host.conns[i+1:]...)
+			conn.evicted = true
+			if conn.idle != nil {
+				conn.idle.Stop()
+			}
+			p.notify()
+			return true
+		}
+	}
+	return false
+}
+
+// Opens a session on the connection, waiting for a session slot if the lease's are all in use and the connection has
+// none free. The slot is given back when the session is closed
+func (c *PooledClient) NewSession() (*PooledSession, error) {
+	if err := c.take(); err != nil {
+		return nil, err
+	}
+	session, err := c.conn.client.NewSession()
+	if err != nil {
+		c.give()
+		return nil, err
+	}
+	return &PooledSession{Session: session, lease: c}, nil
+}
+
+// Dials addr from the remote host in a session slot, as NewSession does. The slot is given back when the connection
+// is closed
+func (c *PooledClient) Dial(network, addr string) (net.Conn, error) {
+	if err := c.take(); err != nil {
+		return nil, err
+	}
+	conn, err := c.conn.client.Dial(network, addr)
+	if err != nil {
+		c.give()
+		return nil, err
+	}
+	return &pooledChannel{Conn: conn, lease: c}, nil
+}
+
+// Takes a session slot for a session or channel, using one the lease holds if it is free
+func (c *PooledClient) take() error {
+	p := c.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if c.released {
+			return LeaseReleased
+		}
+		if p.closed {
+			return PoolClosed
+		}
+		// slots aren't counted once the connection is evicted, so opening on it fails as it should
+		if c.open < c.slots || c.conn.sessions < p.maxSessions || c.conn.evicted {
+			if c.open == c.slots {
+				c.slots++
+				c.conn.sessions++
+			}
+			c.open++
+			return nil
+		}
+		changed := p.changed
+		p.mu.Unlock()
+		<-changed
+		p.mu.Lock()
+	}
+}
+
+// Gives back the slot of a closed session or channel, keeping one for the lease until it is released
+func (c *PooledClient) give() {
+	p := c.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c.open--
+	keep := c.open
+	if keep == 0 && !c.released {
+		keep = 1
+	}
+	if c.slots > keep {
+		c.slots--
+		p.giveBack(c.host, c.conn, 1)
+	}
+}
+
+// Returns the lease to the pool. Sessions and channels still open keep their slots until they are closed, and no more
+// can be opened
+func (c *PooledClient) Release() {
+	p := c.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c.released {
+		return
+	}
+	c.released = true
+	if free := c.slots - c.open; free > 0 {
+		c.slots = c.open
+		p.giveBack(c.host, c.conn, free)
+	}
+}
+
+// Closes the session and gives its slot back
+func (s *PooledSession) Close() error {
+	err := s.Session.Close()
+	s.once.Do(s.lease.give)
+	return err
+}
+
+// Closes the channel and gives its slot back
+func (c *pooledChannel) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.lease.give)
+	return err
+}
+
+func (c *pooledChannel) CloseWrite() error {
+	if closeWriter, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closeWriter.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// Closes conn if it is still idle
+func (p *Pool) closeIdle(host *poolHost, conn *poolConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if conn.sessions > 0 || conn.idle == nil {
+		return
+	}
+	if p.remove(host, conn) {
+		p.stats.IdleClosed++
+		conn.client.Close()
+	}
+}
+
+// Returns the pool's connections and counters
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Hosts = make(map[string]PoolHostStats)
+	for key, host := range p.hosts {
+		if len(host.conns) == 0 {
+			continue
+		}
+		hostStats := PoolHostStats{Conns: len(host.conns)}
+		for _, conn := range host.conns {
+			hostStats.Sessions += conn.sessions
+		}
+		stats.Hosts[key] = hostStats
+	}
+	return stats
+}
+
+// Closes every connection in the pool. Connections still lent out are closed as well
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	var err error
+	for _, host := range p.hosts {
+		for _, conn := range host.conns {
+			if conn.idle != nil {
+				conn.idle.Stop()
+			}
+			if closeErr := conn.client.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		host.conns = nil
+	}
+	p.notify()
+	return err
+}
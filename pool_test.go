@@ -0,0 +1,241 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Returns an SshConfig defining the alias "test" for the server listening on port, using the test key
+func loadTestSshConfig(dir string, port int) (*SshConfig, error) {
+	keyPath := filepath.Join(dir, "id_test")
+	if err := ioutil.WriteFile(keyPath, []byte(testPrivateKey), 0600); err != nil {
+		return nil, err
+	}
+	configPath := filepath.Join(dir, "config")
+	config := fmt.Sprintf("Host test\n  HostName 127.0.0.1\n  Port %d\n  IdentityFile %s\n  IdentitiesOnly yes\n  StrictHostKeyChecking no\n", port, keyPath)
+	if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+		return nil, err
+	}
+	return LoadSshConfig(configPath)
+}
+
+func TestPool(t *testing.T) {
+	Convey("Given a pool of connections to an ssh server", t, func() {
+		server, err := startTestServer(newTestPublicKeyServer())
+		So(err, ShouldBeNil)
+		dir, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+		_, port := splitTestAddr(server.Addr())
+		config, err := loadTestSshConfig(dir, port)
+		So(err, ShouldBeNil)
+		pool := NewPool(config, 2, 0)
+		ctx := context.Background()
+		key := CurrentUser + "@" + server.Addr().String()
+
+		Convey("Sessions should share connections up to the session limit", func() {
+			var clients []*PooledClient
+			for i := 0; i < 3; i++ {
+				c, err := pool.Get(ctx, "test")
+				So(err, ShouldBeNil)
+				clients = append(clients, c)
+			}
+			So(clients[0].conn == clients[1].conn, ShouldBeTrue)
+			So(clients[2].conn == clients[0].conn, ShouldBeFalse)
+			stats := pool.Stats()
+			So(stats.Dials, ShouldEqual, 2)
+			So(stats.Hosts[key], ShouldResemble, PoolHostStats{Conns: 2, Sessions: 3})
+
+			for _, c := range clients {
+				c.Release()
+			}
+			clients[0].Release()
+			So(pool.Stats().Hosts[key], ShouldResemble, PoolHostStats{Conns: 2, Sessions: 0})
+
+			// the same host given differently shares the connections
+			err := pool.Do(ctx, CurrentUser+"@test", func(c *PooledClient) error {
+				session, err := c.NewSession()
+				if err != nil {
+					return err
+				}
+				defer session.Close()
+				return session.Run("true")
+			})
+			So(err, ShouldBeNil)
+			So(pool.Stats().Dials, ShouldEqual, 2)
+		})
+
+		Convey("Concurrent callers should not dial more connections than they need", func() {
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			var errs []error
+			for i := 0; i < 6; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					err := pool.Do(ctx, "test", func(c *PooledClient) error {
+						time.Sleep(100 * time.Millisecond)
+						return nil
+					})
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+			for _, err := range errs {
+				So(err, ShouldBeNil)
+			}
+			So(pool.Stats().Dials, ShouldBeLessThanOrEqualTo, 3)
+		})
+
+		Convey("Dropped connections should be evicted", func() {
+			c, err := pool.Get(ctx, "test")
+			So(err, ShouldBeNil)
+			c.conn.client.Close()
+			c.Release()
+			for i := 0; i < 100 && pool.Stats().Evictions == 0; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(pool.Stats().Evictions, ShouldEqual, 1)
+			So(pool.Stats().Hosts, ShouldBeEmpty)
+
+			c, err = pool.Get(ctx, "test")
+			So(err, ShouldBeNil)
+			session, err := c.NewSession()
+			So(err, ShouldBeNil)
+			So(session.Run("true"), ShouldBeNil)
+			session.Close()
+			c.Release()
+			So(pool.Stats().Dials, ShouldEqual, 2)
+		})
+
+		Convey("A lease should wait for a free slot rather than open more sessions than the limit", func() {
+			c, err := pool.Get(ctx, "test")
+			So(err, ShouldBeNil)
+			first, err := c.NewSession()
+			So(err, ShouldBeNil)
+			echo, err := startEchoServer()
+			So(err, ShouldBeNil)
+			defer echo.Close()
+			channel, err := c.Dial("tcp", echo.Addr().String())
+			So(err, ShouldBeNil)
+			So(pool.Stats().Hosts[key], ShouldResemble, PoolHostStats{Conns: 1, Sessions: 2})
+
+			opened := make(chan *PooledSession, 1)
+			go func() {
+				session, err := c.NewSession()
+				if err != nil {
+					session = nil
+				}
+				opened <- session
+			}()
+			var third *PooledSession
+			select {
+			case third = <-opened:
+			case <-time.After(100 * time.Millisecond):
+			}
+			So(third, ShouldBeNil)
+
+			So(channel.Close(), ShouldBeNil)
+			select {
+			case third = <-opened:
+			case <-time.After(5 * time.Second):
+			}
+			So(third, ShouldNotBeNil)
+			So(pool.Stats().Hosts[key], ShouldResemble, PoolHostStats{Conns: 1, Sessions: 2})
+
+			// sessions left open keep their slots past the release
+			first.Close()
+			c.Release()
+			So(pool.Stats().Hosts[key], ShouldResemble, PoolHostStats{Conns: 1, Sessions: 1})
+			third.Close()
+			So(pool.Stats().Hosts[key], ShouldResemble, PoolHostStats{Conns: 1, Sessions: 0})
+			_, err = c.NewSession()
+			So(err, ShouldEqual, LeaseReleased)
+		})
+
+		Convey("Connections which stop answering keepalives should be evicted", func() {
+			proxy, err := startTestFreezingProxy(server.Addr().String())
+			So(err, ShouldBeNil)
+			defer proxy.Close()
+			_, proxyPort := splitTestAddr(proxy.Addr())
+			proxyConfig, err := loadTestSshConfig(dir, proxyPort)
+			So(err, ShouldBeNil)
+			proxyPool := NewPool(proxyConfig, 2, 0)
+			proxyPool.keepaliveInterval = 100 * time.Millisecond
+			defer proxyPool.Close()
+
+			c, err := proxyPool.Get(ctx, "test")
+			So(err, ShouldBeNil)
+			c.Release()
+			proxy.frozen.Lock()
+			for i := 0; i < 100 && proxyPool.Stats().Evictions == 0; i++ {
+				time.Sleep(20 * time.Millisecond)
+			}
+			proxy.frozen.Unlock()
+			So(proxyPool.Stats().Evictions, ShouldEqual, 1)
+			So(proxyPool.Stats().Hosts, ShouldBeEmpty)
+		})
+
+		Convey("Idle connections should be closed", func() {
+			idlePool := NewPool(config, 2, 50*time.Millisecond)
+			defer idlePool.Close()
+			c, err := idlePool.Get(ctx, "test")
+			So(err, ShouldBeNil)
+			c.Release()
+			for i := 0; i < 100 && idlePool.Stats().IdleClosed == 0; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			stats := idlePool.Stats()
+			So(stats.IdleClosed, ShouldEqual, 1)
+			So(stats.Evictions, ShouldEqual, 0)
+			So(stats.Hosts, ShouldBeEmpty)
+		})
+
+		Convey("A closed pool should not hand out connections", func() {
+			So(pool.Close(), ShouldBeNil)
+			_, err := pool.Get(ctx, "test")
+			So(err, ShouldEqual, PoolClosed)
+		})
+
+		Convey("Dial failures should be returned and counted", func() {
+			_, err := pool.Get(ctx, "test:1")
+			So(err, ShouldNotBeNil)
+			So(pool.Stats().DialFailures, ShouldEqual, 1)
+		})
+
+		Reset(func() {
+			pool.Close()
+			server.Close()
+			os.RemoveAll(dir)
+		})
+	})
+}
@@ -18,14 +18,26 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
 // THE SOFTWARE.
 
-// RCURL (remote curl) creates an ssh session and then curls a remote host. Good for environments with VPCs and VPNs
+// RCURL (remote curl) creates an ssh session and then makes an http request from the remote host, over a direct-tcpip
+// channel, so that curl is not needed there. Good for environments with VPCs and VPNs:
+//
+//	rcurl -H bastion -u http://10.0.0.11:8080/health
+//	rcurl -H bastion -X PUT -header 'Content-Type: application/json' -data @body.json -u https://api.internal/items/1
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 
 	smssh "sessionm/shared/net/ssh"
@@ -34,79 +46,211 @@ import (
 )
 
 var (
-	sshHost        = flag.String("H", "", "the remote host with which to begin an ssh session")
-	remoteUrl      = flag.String("u", "", "the host url that you would like to curl")
-	options        = flag.String("o", "", `the curl options you would like to use, surrounded in quotes, ex: -o=""`)
-	privateKeyFile = flag.String("P", "", "if specified, the location of the private key file to use for the ssh session - if not provided, the system default path will be attempted - MacOS(/Users/{user}/.ssh/id_rsa), Linux(/home/{user}/.ssh/id_rsa)")
+	sshHost         = flag.String("H", "", "the remote host with which to begin an ssh session, as [user@]host[:port]. host may be an alias from the ssh config")
+	hostFlags       = smssh.NewHostFlags(flag.CommandLine, false)
+	remoteUrl       = flag.String("u", "", "the url to request from the remote host")
+	method          = flag.String("X", "", "the request method. defaults to POST when -data is given and GET otherwise")
+	data            = flag.String("data", "", "the request body. @file reads it from a file, and @- from stdin")
+	outputFile      = flag.String("output", "", "write the response body to this file instead of stdout")
+	insecure        = flag.Bool("insecure", false, "do not verify the server's TLS certificate")
+	caCert          = flag.String("cacert", "", "a PEM file of CA certificates to verify the server's TLS certificate with, instead of the system's")
+	followRedirects = flag.Bool("follow_redirects", false, "follow redirects, as curl -L does")
+	maxRedirects    = flag.Int("max_redirects", 10, "the most redirects to follow with -follow_redirects")
+	options         = flag.String("o", "", `deprecated: run curl on the remote host with these options instead of making the request over the ssh connection, surrounded in quotes, ex: -o='-H "Accept: application/json"'. the other request flags are not used`)
+	timeout         = flag.Duration("timeout", 0, "the longest to wait for the request to finish, ex: 30s. 0 waits indefinitely")
+
+	headers headerFlags
 )
 
 var (
 	NoSshHostGiven = errors.New("-H option (remote host) is required.")
 	NoRemoteUrl    = errors.New("-u option (remote url) is required.")
+	BadHeader      = errors.New("-header must be given as 'Name: value'")
+	BadCACert      = errors.New("-cacert contains no PEM certificates")
 )
 
+// headerFlags collects every -header given
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(value string) error {
+	*h = append(*h, value)
+	return nil
+}
+
+func init() {
+	flag.Var(&headers, "header", "a request header as 'Name: value'. may be given more than once")
+}
+
 func main() {
 	parseFlags()
-	conn, err := setupConn()
+
+	// interrupting rcurl closes the ssh session rather than leaving the request running on the remote host
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	conn, err := setupConn(ctx)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(-1)
 	}
+	defer conn.Close()
 
-	var data []byte
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
 	if *options != "" {
-		data, err = smssh.CurlFromRemote(conn, *remoteUrl, strings.Split(*options, " ")...)
+		err = remoteCurl(ctx, conn)
 	} else {
-		data, err = smssh.CurlFromRemote(conn, *remoteUrl)
+		err = request(ctx, conn)
 	}
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(-1)
 	}
-	fmt.Println(string(data))
 }
 
-func parseFlags() {
-	flag.Parse()
-	if *sshHost == "" {
-		fmt.Printf(NoSshHostGiven.Error())
+// Makes the request over a direct-tcpip channel of conn and writes the response body to the output
+func request(ctx context.Context, conn *ssh.Client) error {
+	req, err := newRequest(ctx)
+	if err != nil {
+		return err
 	}
-	if *remoteUrl == "" {
-		fmt.Printf(NoRemoteUrl.Error())
+	client, err := newClient(conn)
+	if err != nil {
+		return err
 	}
-}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
-func setupConn() (*ssh.Client, error) {
-
-	if !strings.Contains(*sshHost, ":") {
-		split := strings.Split(*sshHost, "/")
-		if len(split) == 1 {
-			*sshHost = split[0] + ":" + "22"
-		} else {
-			*sshHost = split[0] + ":" + "22"
-			for i, s := range split {
-				if i != 0 {
-					*sshHost = fmt.Sprintf("%s/%s", *sshHost, s)
-				}
-			}
+	var out io.Writer = os.Stdout
+	if *outputFile != "" {
+		f, err := os.Create(*outputFile)
+		if err != nil {
+			return err
 		}
+		defer f.Close()
+		out = f
 	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
 
-	var config *ssh.ClientConfig
-	if *privateKeyFile != "" {
-		auth, err := smssh.ParsePrivateKey(*privateKeyFile)
+// Returns the request described by the flags
+func newRequest(ctx context.Context) (*http.Request, error) {
+	// bodies are read in full so that the request has a Content-Length, which some servers require
+	var body io.Reader
+	if *data != "" {
+		content := []byte(*data)
+		var err error
+		if *data == "@-" {
+			content, err = ioutil.ReadAll(os.Stdin)
+		} else if strings.HasPrefix(*data, "@") {
+			content, err = ioutil.ReadFile((*data)[1:])
+		}
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(-1)
+			return nil, err
 		}
-		config = &ssh.ClientConfig{User: smssh.CurrentUser, Auth: []ssh.AuthMethod{auth}}
-	} else {
-		err := smssh.SetupDefaultClientConfig()
+		body = bytes.NewReader(content)
+	}
+	m := *method
+	if m == "" {
+		m = http.MethodGet
+		if body != nil {
+			m = http.MethodPost
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, strings.ToUpper(m), *remoteUrl, body)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, BadHeader
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		// Host is not sent from the header map
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Add(name, value)
+	}
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return req, nil
+}
+
+// Returns an http client over conn which verifies TLS and follows redirects as the flags say
+func newClient(conn *ssh.Client) (*http.Client, error) {
+	client := smssh.NewHttpClient(conn)
+	transport := client.Transport.(*http.Transport)
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: *insecure}
+	if *caCert != "" {
+		pem, err := ioutil.ReadFile(*caCert)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(-1)
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, BadCACert
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !*followRedirects {
+			return http.ErrUseLastResponse
 		}
-		config = smssh.DefaultClientConfig
+		if len(via) > *maxRedirects {
+			return fmt.Errorf("Stopped after %d redirects", *maxRedirects)
+		}
+		return nil
+	}
+	return client, nil
+}
+
+// Runs curl on the remote host with the -o options, as rcurl used to
+func remoteCurl(ctx context.Context, conn *ssh.Client) error {
+	// options are split the way a shell would split them, so quoted options containing spaces stay together
+	args, err := smssh.SplitArgs(*options)
+	if err != nil {
+		return err
+	}
+	out, err := smssh.CurlFromRemoteContext(ctx, conn, *remoteUrl, args...)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func parseFlags() {
+	flag.Parse()
+	if *sshHost == "" {
+		fmt.Println(NoSshHostGiven)
+		os.Exit(-1)
+	}
+	if *remoteUrl == "" {
+		fmt.Println(NoRemoteUrl)
+		os.Exit(-1)
+	}
+}
+
+func setupConn(ctx context.Context) (*ssh.Client, error) {
+	smssh.DefaultPassphraseCallback = smssh.TerminalPassphrase
+	// the flags take precedence over the ssh config when given
+	host, err := hostFlags.Resolve(*sshHost)
+	if err != nil {
+		return nil, err
 	}
-	return smssh.GetSshConn(*sshHost, config)
+	return host.DialContext(ctx)
 }
@@ -0,0 +1,84 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// RSH (remote shell) opens an interactive session on a remote host, like ssh. The local terminal is put in raw mode,
+// the remote pty follows its size, and rsh exits with the remote command's status. Any arguments after the flags are
+// run as the remote command instead of the login shell
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	smssh "sessionm/shared/net/ssh"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	sshHost   = flag.String("H", "", "the remote host to open a shell on, as [user@]host[:port]. host may be an alias from the ssh config")
+	hostFlags = smssh.NewHostFlags(flag.CommandLine, false)
+	termName  = flag.String("term", "", "the TERM of the remote pty. defaults to $TERM")
+)
+
+// The status rsh exits with when the remote command's status is unknown, as with ssh
+const unknownStatus = 255
+
+var (
+	NoSshHostGiven = errors.New("-H option (remote host) is required.")
+)
+
+func main() {
+	flag.Parse()
+	if *sshHost == "" {
+		fmt.Println(NoSshHostGiven)
+		os.Exit(-1)
+	}
+	conn, err := setupConn()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	// like ssh, the arguments are joined into one command line for the remote shell
+	result, err := smssh.Shell(conn, smssh.ShellOptions{Command: strings.Join(flag.Args(), " "), Term: *termName})
+	var cmdErr *smssh.CommandError
+	if err != nil && !errors.As(err, &cmdErr) {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	conn.Close()
+	if result == nil || result.ExitStatus < 0 {
+		os.Exit(unknownStatus)
+	}
+	os.Exit(result.ExitStatus)
+}
+
+func setupConn() (*ssh.Client, error) {
+	smssh.DefaultPassphraseCallback = smssh.TerminalPassphrase
+	// the flags take precedence over the ssh config when given
+	host, err := hostFlags.Resolve(*sshHost)
+	if err != nil {
+		return nil, err
+	}
+	return host.Dial()
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Result describes a remote command which has finished
+type Result struct {
+	Command string
+	// The status the command exited with, 128 plus the signal number if it was killed by a signal as a shell reports
+	// it, or -1 if its status is unknown
+	ExitStatus int
+	// The name of the signal which killed the command, such as "KILL", or empty
+	Signal   string
+	Stdout   []byte
+	Stderr   []byte
+	Duration time.Duration
+}
+
+// Whether the command exited with status 0
+func (r *Result) Success() bool {
+	return r.ExitStatus == 0 && r.Signal == ""
+}
+
+// CommandError is returned when a remote command exits unsuccessfully. It wraps the command's *ssh.ExitError
+type CommandError struct {
+	Result *Result
+	Err    *ssh.ExitError
+}
+
+func (e *CommandError) Error() string {
+	stderr := strings.TrimSpace(string(e.Result.Stderr))
+	if stderr == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Err, stderr)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// The status the command exited with, or 128 plus the signal number if it was killed by a signal
+func (e *CommandError) ExitStatus() int {
+	return e.Result.ExitStatus
+}
+
+// Runs cmd in a new session, returning its output and how it exited. A *CommandError is returned along with the
+// result if cmd exits unsuccessfully
+func Run(conn *ssh.Client, cmd string) (*Result, error) {
+	return RunContext(context.Background(), conn, cmd)
+}
+
+// Runs cmd like Run, closing the session if ctx is done before cmd exits. The result then holds the output received
+// until ctx was done
+func RunContext(ctx context.Context, conn *ssh.Client, cmd string) (*Result, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	start := time.Now()
+	err = withContext(ctx, session, func() error {
+		return session.Run(cmd)
+	})
+	return newResult(cmd, stdout.Bytes(), stderr.Bytes(), time.Since(start), err)
+}
+
+// Describes a command which finished with err, returning a *CommandError in place of an *ssh.ExitError
+func newResult(cmd string, stdout, stderr []byte, duration time.Duration, err error) (*Result, error) {
+	result := &Result{Command: cmd, Stdout: stdout, Stderr: stderr, Duration: duration}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitStatus = exitErr.ExitStatus()
+		result.Signal = exitErr.Signal()
+		return result, &CommandError{Result: result, Err: exitErr}
+	}
+	if err != nil {
+		result.ExitStatus = -1
+	}
+	return result, err
+}
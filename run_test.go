@@ -0,0 +1,83 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRun(t *testing.T) {
+	Convey("Given a connection to an ssh server", t, func() {
+		_, conn := newTestConn(t)
+
+		Convey("A successful command should return its output", func() {
+			result, err := Run(conn, "echo out; echo err >&2")
+			So(err, ShouldBeNil)
+			So(result.Success(), ShouldBeTrue)
+			So(result.ExitStatus, ShouldEqual, 0)
+			So(string(result.Stdout), ShouldEqual, "out\n")
+			So(string(result.Stderr), ShouldEqual, "err\n")
+			So(result.Duration, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("A failing command should return a CommandError wrapping the exit error", func() {
+			result, err := Run(conn, "echo partial; echo 'no such thing' >&2; exit 3")
+			So(err, ShouldNotBeNil)
+			So(result.Success(), ShouldBeFalse)
+			So(result.ExitStatus, ShouldEqual, 3)
+			So(string(result.Stdout), ShouldEqual, "partial\n")
+
+			var cmdErr *CommandError
+			So(errors.As(err, &cmdErr), ShouldBeTrue)
+			So(cmdErr.ExitStatus(), ShouldEqual, 3)
+			So(cmdErr.Error(), ShouldEndWith, ": no such thing")
+			var exitErr *ssh.ExitError
+			So(errors.As(err, &exitErr), ShouldBeTrue)
+		})
+
+		Convey("A command killed by a signal should report the signal", func() {
+			result, err := Run(conn, "kill -TERM $$")
+			So(err, ShouldHaveSameTypeAs, &CommandError{})
+			So(result.Signal, ShouldEqual, "TERM")
+			So(result.ExitStatus, ShouldEqual, 128+15)
+		})
+
+		Convey("Removing a non-empty directory should report rmdir's error", func() {
+			dir, err := ioutil.TempDir("", "")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			So(ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0600), ShouldBeNil)
+
+			_, err = Run(conn, NewCommand("rmdir", "--", dir).String())
+			var cmdErr *CommandError
+			So(errors.As(err, &cmdErr), ShouldBeTrue)
+			So(strings.ToLower(cmdErr.Error()), ShouldContainSubstring, "not empty")
+		})
+	})
+}
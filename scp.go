@@ -0,0 +1,630 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// scp protocol response codes, sent after every record and after file contents
+const (
+	scpOK      = 0
+	scpWarning = 1
+	scpFatal   = 2
+)
+
+// errors
+var (
+	ScpProtocolError = errors.New("Unexpected response from remote scp")
+	NotARegularFile  = errors.New("Not a regular file")
+)
+
+// CopyFilter chooses which files are copied by CopyDir and CopyDirFromRemote. Patterns use the syntax of path.Match
+// and are matched against both the slash separated path relative to the directory being copied and its base name, so
+// "*.conf" matches every .conf file in the tree while "conf/*.conf" only matches those in the conf directory. A nil
+// filter copies everything
+type CopyFilter struct {
+	// If not empty, only files matching at least one of these patterns are copied. Directories are always entered
+	Include []string
+	// Files and directories matching any of these patterns are skipped, along with everything beneath them
+	Exclude []string
+}
+
+// Checks that all of the filter's patterns are well formed
+func (f *CopyFilter) validate() error {
+	if f == nil {
+		return nil
+	}
+	for _, pattern := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s: %q", err, pattern)
+		}
+	}
+	return nil
+}
+
+// Whether the file or directory at the relative path rel should be copied
+func (f *CopyFilter) allows(rel string, isDir bool) bool {
+	if f == nil {
+		return true
+	}
+	if matchesAny(f.Exclude, rel) {
+		return false
+	}
+	return isDir || len(f.Include) == 0 || matchesAny(f.Include, rel)
+}
+
+func matchesAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ScpError is an error message reported by the remote scp process
+type ScpError struct {
+	// Whether the remote scp gave up (a fatal error) or is continuing with the next file (a warning)
+	Fatal   bool
+	Message string
+}
+
+func (e *ScpError) Error() string {
+	return e.Message
+}
+
+// scpRecord is a single control record of the scp protocol
+type scpRecord struct {
+	// 'C' for a file, 'D' to enter a directory, 'E' to leave it, or 'T' for the times of the next file or directory
+	Type  byte
+	Mode  os.FileMode
+	Size  int64
+	Name  string
+	Mtime time.Time
+	Atime time.Time
+}
+
+// scpFileInfo is the os.FileInfo of a file or directory received over scp
+type scpFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	// the access time is kept only so that it can be restored on the local copy
+	accessTime time.Time
+}
+
+func (fi *scpFileInfo) Name() string       { return fi.name }
+func (fi *scpFileInfo) Size() int64        { return fi.size }
+func (fi *scpFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *scpFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *scpFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *scpFileInfo) Sys() interface{}   { return nil }
+
+func newScpFileInfo(record scpRecord) *scpFileInfo {
+	return &scpFileInfo{name: record.Name, size: record.Size, mode: record.Mode, modTime: record.Mtime, accessTime: record.Atime}
+}
+
+// scpConn is one end of an scp session; the remote scp reads from in and writes to out
+type scpConn struct {
+	session *ssh.Session
+	in      io.WriteCloser
+	out     *bufio.Reader
+	// the command line and stderr of the remote scp, for the error returned if it fails
+	cmd    string
+	stderr bytes.Buffer
+	start  time.Time
+}
+
+// Starts the remote scp with the given arguments
+func startScp(conn *ssh.Client, args ...string) (*scpConn, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	in, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	out, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	c := &scpConn{session: session, in: in, out: bufio.NewReader(out), cmd: NewCommand("scp", args...).String(), start: time.Now()}
+	session.Stderr = &c.stderr
+	if err := session.Start(c.cmd); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Signals the end of the transfer and waits for the remote scp to exit. A *CommandError is returned if it fails
+func (c *scpConn) finish() error {
+	c.in.Close()
+	err := c.session.Wait()
+	_, err = newResult(c.cmd, nil, c.stderr.Bytes(), time.Since(c.start), err)
+	return err
+}
+
+// Closes the session, which also terminates the remote scp if it is still running
+func (c *scpConn) Close() error {
+	return c.session.Close()
+}
+
+// Tells the remote scp that the last record or file was received
+func (c *scpConn) ack() error {
+	_, err := c.in.Write([]byte{scpOK})
+	return err
+}
+
+// Reads the response to the last record or file sent, returning an *ScpError if the remote scp reported one
+func (c *scpConn) readAck() error {
+	b, err := c.out.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch b {
+	case scpOK:
+		return nil
+	case scpWarning, scpFatal:
+		return c.readError(b)
+	default:
+		return ScpProtocolError
+	}
+}
+
+// Reads the message that follows a warning or fatal response code
+func (c *scpConn) readError(code byte) error {
+	message, err := c.out.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	return &ScpError{Fatal: code == scpFatal, Message: strings.TrimSuffix(message, "\n")}
+}
+
+// Sends a control record and reads its response
+func (c *scpConn) send(record scpRecord) error {
+	var line string
+	switch record.Type {
+	case 'C', 'D':
+		line = fmt.Sprintf("%c%04o %d %s\n", record.Type, record.Mode.Perm(), record.Size, record.Name)
+	case 'E':
+		line = "E\n"
+	case 'T':
+		line = fmt.Sprintf("T%d 0 %d 0\n", record.Mtime.Unix(), record.Atime.Unix())
+	}
+	if _, err := io.WriteString(c.in, line); err != nil {
+		return err
+	}
+	return c.readAck()
+}
+
+// Sends a local file, preceded by its modification time
+func (c *scpConn) sendFile(localPath string, info os.FileInfo) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := c.send(scpRecord{Type: 'T', Mtime: info.ModTime(), Atime: info.ModTime()}); err != nil {
+		return err
+	}
+	if err := c.send(scpRecord{Type: 'C', Mode: info.Mode(), Size: info.Size(), Name: info.Name()}); err != nil {
+		return err
+	}
+	return c.sendContents(info.Size(), f)
+}
+
+// Sends a local directory and the files beneath it that are allowed by filter. rel is the directory's path relative
+// to the root of the copy. Symbolic links are followed, as they are by scp
+func (c *scpConn) sendDir(localDir, rel string, info os.FileInfo, filter *CopyFilter) error {
+	entries, err := ioutil.ReadDir(localDir)
+	if err != nil {
+		return err
+	}
+	if err := c.send(scpRecord{Type: 'T', Mtime: info.ModTime(), Atime: info.ModTime()}); err != nil {
+		return err
+	}
+	if err := c.send(scpRecord{Type: 'D', Mode: info.Mode(), Name: info.Name()}); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		entryPath := filepath.Join(localDir, entry.Name())
+		entryRel := path.Join(rel, entry.Name())
+		entryInfo, err := os.Stat(entryPath)
+		if err != nil {
+			return err
+		}
+		if !filter.allows(entryRel, entryInfo.IsDir()) {
+			continue
+		}
+		if entryInfo.IsDir() {
+			err = c.sendDir(entryPath, entryRel, entryInfo, filter)
+		} else if entryInfo.Mode().IsRegular() {
+			err = c.sendFile(entryPath, entryInfo)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return c.send(scpRecord{Type: 'E'})
+}
+
+// Sends a file's contents after its 'C' record, followed by the end of file marker
+func (c *scpConn) sendContents(size int64, contents io.Reader) error {
+	if _, err := io.CopyN(c.in, contents, size); err != nil {
+		return err
+	}
+	if _, err := c.in.Write([]byte{scpOK}); err != nil {
+		return err
+	}
+	return c.readAck()
+}
+
+// Reads the next control record sent by the remote scp. io.EOF is returned once the remote scp has nothing left to send
+func (c *scpConn) next() (scpRecord, error) {
+	record := scpRecord{}
+	b, err := c.out.ReadByte()
+	if err != nil {
+		return record, err
+	}
+	if b == scpWarning || b == scpFatal {
+		return record, c.readError(b)
+	}
+	line, err := c.out.ReadString('\n')
+	if err != nil {
+		return record, err
+	}
+	record.Type = b
+	line = strings.TrimSuffix(line, "\n")
+
+	switch record.Type {
+	case 'C', 'D':
+		// C<mode> <size> <name>
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return record, ScpProtocolError
+		}
+		mode, err := strconv.ParseUint(fields[0], 8, 32)
+		if err != nil {
+			return record, ScpProtocolError
+		}
+		record.Size, err = strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return record, ScpProtocolError
+		}
+		record.Mode = os.FileMode(mode).Perm()
+		if record.Type == 'D' {
+			record.Mode |= os.ModeDir
+		}
+		record.Name = fields[2]
+		if record.Name == "" || record.Name == "." || record.Name == ".." || strings.Contains(record.Name, "/") {
+			return record, fmt.Errorf("Invalid file name from remote scp: %q", record.Name)
+		}
+	case 'T':
+		// T<mtime> <mtime usec> <atime> <atime usec>
+		var mtime, mtimeUsec, atime, atimeUsec int64
+		if _, err := fmt.Sscanf(line, "%d %d %d %d", &mtime, &mtimeUsec, &atime, &atimeUsec); err != nil {
+			return record, ScpProtocolError
+		}
+		record.Mtime = time.Unix(mtime, mtimeUsec*1000)
+		record.Atime = time.Unix(atime, atimeUsec*1000)
+	case 'E':
+	default:
+		return record, ScpProtocolError
+	}
+	return record, nil
+}
+
+// Reads the next record, folding a preceding 'T' record into the times of the record that follows it
+func (c *scpConn) nextWithTimes() (scpRecord, error) {
+	record, err := c.next()
+	if err != nil || record.Type != 'T' {
+		return record, err
+	}
+	if err := c.ack(); err != nil {
+		return record, err
+	}
+	times := record
+	record, err = c.next()
+	record.Mtime, record.Atime = times.Mtime, times.Atime
+	return record, err
+}
+
+// Receives the contents of the file announced by record into w and acknowledges them
+func (c *scpConn) receiveContents(record scpRecord, w io.Writer) error {
+	if err := c.ack(); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, c.out, record.Size); err != nil {
+		return err
+	}
+	if err := c.readAck(); err != nil {
+		return err
+	}
+	return c.ack()
+}
+
+// Runs scp in source mode for remotePath and receives a single file, calling create to get the destination for its
+// contents once the file's name, mode and times are known. The session is closed if ctx is done first
+func scpReceiveFile(ctx context.Context, conn *ssh.Client, remotePath string, create func(info *scpFileInfo) (io.Writer, error)) (*scpFileInfo, error) {
+	c, err := startScp(conn, "-f", "-p", "--", remotePath)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var info *scpFileInfo
+	err = withContext(ctx, c, func() error {
+		if err := c.ack(); err != nil {
+			return err
+		}
+		record, err := c.nextWithTimes()
+		if err != nil {
+			return err
+		}
+		if record.Type != 'C' {
+			return NotARegularFile
+		}
+		info = newScpFileInfo(record)
+		w, err := create(info)
+		if err != nil {
+			return err
+		}
+		if err := c.receiveContents(record, w); err != nil {
+			return err
+		}
+		return c.finish()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Copies a remote file to w over scp, returning the remote file's name, size, permissions and modification time
+func CopyFromRemote(conn *ssh.Client, remotePath string, w io.Writer) (os.FileInfo, error) {
+	return CopyFromRemoteContext(context.Background(), conn, remotePath, w)
+}
+
+// Copies a remote file to w like CopyFromRemote, closing the session if ctx is done first
+func CopyFromRemoteContext(ctx context.Context, conn *ssh.Client, remotePath string, w io.Writer) (os.FileInfo, error) {
+	return scpReceiveFile(ctx, conn, remotePath, func(info *scpFileInfo) (io.Writer, error) {
+		return w, nil
+	})
+}
+
+// Copies a remote file to localPath over scp, preserving its permissions and modification time. If localPath is an
+// existing directory the file is created inside it with its remote name
+func CopyFileFromRemote(conn *ssh.Client, remotePath, localPath string) error {
+	return CopyFileFromRemoteContext(context.Background(), conn, remotePath, localPath)
+}
+
+// Copies a remote file to localPath like CopyFileFromRemote, closing the session if ctx is done first
+func CopyFileFromRemoteContext(ctx context.Context, conn *ssh.Client, remotePath, localPath string) error {
+	var f *os.File
+	info, err := scpReceiveFile(ctx, conn, remotePath, func(info *scpFileInfo) (io.Writer, error) {
+		if s, err := os.Stat(localPath); err == nil && s.IsDir() {
+			localPath = filepath.Join(localPath, info.Name())
+		}
+		var err error
+		f, err = os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+		return f, err
+	})
+	if f != nil {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return setLocalFileInfo(localPath, info)
+}
+
+// Applies the permissions and times received over scp to a local file, since the umask applies when it is created
+func setLocalFileInfo(localPath string, info *scpFileInfo) error {
+	if err := os.Chmod(localPath, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if info.ModTime().IsZero() {
+		return nil
+	}
+	return os.Chtimes(localPath, info.accessTime, info.ModTime())
+}
+
+// Copies a local directory tree into the remote directory destinationPath over scp, preserving permissions and
+// modification times. Only the files allowed by filter are copied, which may be nil to copy everything
+func CopyDir(localDir, destinationPath string, conn *ssh.Client, filter *CopyFilter) error {
+	return CopyDirContext(context.Background(), localDir, destinationPath, conn, filter)
+}
+
+// Copies a local directory tree like CopyDir, closing the session if ctx is done first
+func CopyDirContext(ctx context.Context, localDir, destinationPath string, conn *ssh.Client, filter *CopyFilter) error {
+	if err := filter.validate(); err != nil {
+		return err
+	}
+	info, err := os.Stat(localDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", localDir)
+	}
+	c, err := startScp(conn, "-r", "-p", "-t", "--", destinationPath)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return withContext(ctx, c, func() error {
+		if err := c.readAck(); err != nil {
+			return err
+		}
+		if err := c.sendDir(localDir, "", info, filter); err != nil {
+			return err
+		}
+		return c.finish()
+	})
+}
+
+// Copies a remote directory tree to localPath over scp, preserving permissions and modification times. As with scp,
+// if localPath is an existing directory the tree is created inside it, and otherwise it is created as localPath. Only
+// the files allowed by filter are written, which may be nil to copy everything
+func CopyDirFromRemote(conn *ssh.Client, remotePath, localPath string, filter *CopyFilter) error {
+	return CopyDirFromRemoteContext(context.Background(), conn, remotePath, localPath, filter)
+}
+
+// Copies a remote directory tree like CopyDirFromRemote, closing the session if ctx is done first
+func CopyDirFromRemoteContext(ctx context.Context, conn *ssh.Client, remotePath, localPath string, filter *CopyFilter) error {
+	if err := filter.validate(); err != nil {
+		return err
+	}
+	c, err := startScp(conn, "-r", "-p", "-f", "--", remotePath)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return withContext(ctx, c, func() error {
+		return c.receiveDir(localPath, filter)
+	})
+}
+
+// Receives the directory tree sent by a remote scp in recursive source mode into localPath
+func (c *scpConn) receiveDir(localPath string, filter *CopyFilter) error {
+	if err := c.ack(); err != nil {
+		return err
+	}
+
+	// the local directories currently being written, their records, and paths relative to the root of the copy
+	var dirs []string
+	var records []scpRecord
+	var rels []string
+	// the number of excluded directories that are currently being skipped
+	skipping := 0
+
+	for {
+		record, err := c.nextWithTimes()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		rel := record.Name
+		if len(rels) > 0 {
+			rel = path.Join(rels[len(rels)-1], record.Name)
+		}
+		target := localPath
+		if len(dirs) > 0 {
+			target = filepath.Join(dirs[len(dirs)-1], record.Name)
+		} else if s, err := os.Stat(localPath); err == nil && s.IsDir() {
+			target = filepath.Join(localPath, record.Name)
+		}
+
+		switch record.Type {
+		case 'D':
+			if skipping > 0 || (len(dirs) > 0 && !filter.allows(rel, true)) {
+				skipping++
+				if err := c.ack(); err != nil {
+					return err
+				}
+				continue
+			}
+			// directories stay writable until they are finished, when their own mode is applied
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			if len(dirs) == 0 {
+				rel = ""
+			}
+			dirs, records, rels = append(dirs, target), append(records, record), append(rels, rel)
+			if err := c.ack(); err != nil {
+				return err
+			}
+		case 'E':
+			if skipping > 0 {
+				skipping--
+			} else if len(dirs) > 0 {
+				dir, dirRecord := dirs[len(dirs)-1], records[len(records)-1]
+				dirs, records, rels = dirs[:len(dirs)-1], records[:len(records)-1], rels[:len(rels)-1]
+				if err := setLocalFileInfo(dir, newScpFileInfo(dirRecord)); err != nil {
+					return err
+				}
+			}
+			if err := c.ack(); err != nil {
+				return err
+			}
+		case 'C':
+			if skipping > 0 || (len(dirs) > 0 && !filter.allows(rel, false)) {
+				if err := c.receiveContents(record, ioutil.Discard); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := receiveLocalFile(c, record, target); err != nil {
+				return err
+			}
+		default:
+			return ScpProtocolError
+		}
+	}
+	return c.finish()
+}
+
+// Receives the contents of the file announced by record into localPath and applies its permissions and times
+func receiveLocalFile(c *scpConn, record scpRecord, localPath string) error {
+	f, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, record.Mode)
+	if err != nil {
+		return err
+	}
+	err = c.receiveContents(record, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return setLocalFileInfo(localPath, newScpFileInfo(record))
+}
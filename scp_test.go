@@ -0,0 +1,168 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestScp(t *testing.T) {
+	Convey("Given a connection to an in-process ssh server", t, func() {
+		_, conn := newTestConn(t)
+		dir, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+
+		Convey("Upload a file with a specific mode", func() {
+			err := CopyWithFileMode(os.FileMode(0640), "uploaded", dir, []byte(fileData), conn)
+			So(err, ShouldBeNil)
+			data, err := ioutil.ReadFile(filepath.Join(dir, "uploaded"))
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, fileData)
+		})
+
+		Convey("Uploading to a missing directory should return the remote scp's error", func() {
+			err := Copy(conn, "uploaded", filepath.Join(dir, "missing", "dir"), []byte(fileData))
+			So(err, ShouldHaveSameTypeAs, &ScpError{})
+		})
+
+		Convey("Given a remote file with a known mode and modification time", func() {
+			remotePath := filepath.Join(dir, "remote")
+			So(ioutil.WriteFile(remotePath, []byte(fileData), 0600), ShouldBeNil)
+			So(os.Chmod(remotePath, 0751), ShouldBeNil)
+			mtime := time.Unix(1136214245, 0)
+			So(os.Chtimes(remotePath, mtime, mtime), ShouldBeNil)
+
+			Convey("Stream it to a writer", func() {
+				buf := bytes.NewBuffer([]byte{})
+				info, err := CopyFromRemote(conn, remotePath, buf)
+				So(err, ShouldBeNil)
+				So(buf.String(), ShouldEqual, fileData)
+				So(info.Name(), ShouldEqual, "remote")
+				So(info.Size(), ShouldEqual, len(fileData))
+				So(info.Mode(), ShouldEqual, os.FileMode(0751))
+				So(info.ModTime().Equal(mtime), ShouldBeTrue)
+			})
+
+			Convey("Copy it into a local directory", func() {
+				localDir, err := ioutil.TempDir("", "")
+				So(err, ShouldBeNil)
+				defer os.RemoveAll(localDir)
+				So(CopyFileFromRemote(conn, remotePath, localDir), ShouldBeNil)
+				s, err := os.Stat(filepath.Join(localDir, "remote"))
+				So(err, ShouldBeNil)
+				So(s.Mode(), ShouldEqual, os.FileMode(0751))
+				So(s.ModTime().Equal(mtime), ShouldBeTrue)
+			})
+
+			Convey("Get its contents in memory", func() {
+				data, name, err := GetRemoteFile(remotePath, conn)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, fileData)
+				So(name, ShouldEqual, "remote")
+			})
+		})
+
+		Convey("Given a directory tree", func() {
+			tree, err := createTestTree()
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(tree)
+
+			Convey("Upload it, excluding temporary files", func() {
+				err := CopyDir(tree, dir, conn, &CopyFilter{Exclude: []string{"*.tmp"}})
+				So(err, ShouldBeNil)
+				root := filepath.Join(dir, filepath.Base(tree))
+				So(testFileContents(filepath.Join(root, "app.conf")), ShouldEqual, fileData)
+				So(testFileContents(filepath.Join(root, "conf.d", "db.conf")), ShouldEqual, fileData)
+				So(testFileContents(filepath.Join(root, "conf.d", "keys", "id")), ShouldEqual, fileData)
+				_, err = os.Stat(filepath.Join(root, "scratch.tmp"))
+				So(os.IsNotExist(err), ShouldBeTrue)
+				s, err := os.Stat(filepath.Join(root, "conf.d", "keys"))
+				So(err, ShouldBeNil)
+				So(s.Mode().Perm(), ShouldEqual, os.FileMode(0700))
+			})
+
+			Convey("Download it, including only .conf files", func() {
+				local := filepath.Join(dir, "download")
+				err := CopyDirFromRemote(conn, tree, local, &CopyFilter{Include: []string{"*.conf"}})
+				So(err, ShouldBeNil)
+				So(testFileContents(filepath.Join(local, "app.conf")), ShouldEqual, fileData)
+				So(testFileContents(filepath.Join(local, "conf.d", "db.conf")), ShouldEqual, fileData)
+				_, err = os.Stat(filepath.Join(local, "conf.d", "keys", "id"))
+				So(os.IsNotExist(err), ShouldBeTrue)
+				_, err = os.Stat(filepath.Join(local, "scratch.tmp"))
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+
+			Convey("Download it, excluding a directory", func() {
+				local := filepath.Join(dir, "download")
+				err := CopyDirFromRemote(conn, tree, local, &CopyFilter{Exclude: []string{"conf.d/keys"}})
+				So(err, ShouldBeNil)
+				So(testFileContents(filepath.Join(local, "scratch.tmp")), ShouldEqual, fileData)
+				So(testFileContents(filepath.Join(local, "conf.d", "db.conf")), ShouldEqual, fileData)
+				_, err = os.Stat(filepath.Join(local, "conf.d", "keys"))
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+
+			Convey("Invalid patterns should be rejected", func() {
+				err := CopyDir(tree, dir, conn, &CopyFilter{Include: []string{"["}})
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("Downloading a missing file should return the remote scp's error", func() {
+			_, err := CopyFromRemote(conn, filepath.Join(dir, "missing"), ioutil.Discard)
+			So(err, ShouldHaveSameTypeAs, &ScpError{})
+		})
+
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+	})
+}
+
+// Creates a directory tree with configuration files, a temporary file and a private directory
+func createTestTree() (string, error) {
+	tree, err := ioutil.TempDir("", "")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Join(tree, "conf.d", "keys"), 0755); err != nil {
+		return "", err
+	}
+	for _, name := range []string{"app.conf", "scratch.tmp", filepath.Join("conf.d", "db.conf"), filepath.Join("conf.d", "keys", "id")} {
+		if err := ioutil.WriteFile(filepath.Join(tree, name), []byte(fileData), 0644); err != nil {
+			return "", err
+		}
+	}
+	return tree, os.Chmod(filepath.Join(tree, "conf.d", "keys"), 0700)
+}
+
+func testFileContents(name string) string {
+	data, _ := ioutil.ReadFile(name)
+	return string(data)
+}
@@ -31,11 +31,13 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"strconv"
 	"sync"
 	"syscall"
 	"unsafe"
 
-	"github.com/kr/pty"
+	"github.com/creack/pty"
+	"github.com/pkg/sftp"
 
 	"net"
 	"sessionm/shared/log"
@@ -77,6 +79,27 @@ type (
 		NetworkInterface() string
 	}
 
+	// FeaturedSshServer is an SshServer which offers optional features to its clients. Servers which do not implement
+	// it offer none of them
+	FeaturedSshServer interface {
+		SshServer
+		// The optional features to enable
+		Features() ServerFeatures
+	}
+
+	// ServerFeatures are the optional features of a server. Each gives authenticated clients more access to the
+	// server's machine or network, so they are off unless enabled
+	ServerFeatures struct {
+		// Open tcp connections from the server to any address for "direct-tcpip" channels
+		DirectTcpip bool
+		// Listen on any address for "tcpip-forward" requests, forwarding connections back to the client
+		RemoteForward bool
+		// Run "exec" requests with bash -c
+		Exec bool
+		// Serve the sftp subsystem
+		Sftp bool
+	}
+
 	defaultServer struct {
 		config           *ssh.ServerConfig
 		port             int
@@ -87,6 +110,15 @@ type (
 
 // Takes an SshServer interface, performs setup, and calls the underlying type's serveSSH()
 func ServeSSH(s SshServer) error {
+	if err := configureServer(s); err != nil {
+		return err
+	}
+	s.serveSSH()
+	return nil
+}
+
+// Installs the server's auth callbacks and host key into its ssh config
+func configureServer(s SshServer) error {
 	s.SshConfig().PublicKeyCallback = s.PublicKeyCallback()
 	s.SshConfig().PasswordCallback = s.PasswordCallback()
 	signer, err := s.Signer()
@@ -94,7 +126,6 @@ func ServeSSH(s SshServer) error {
 		return err
 	}
 	s.SshConfig().AddHostKey(signer)
-	s.serveSSH()
 	return nil
 }
 
@@ -106,9 +137,20 @@ func DefaultSshHandler(s SshServer) {
 		log.Error(err)
 		return
 	}
+	var features ServerFeatures
+	if featured, ok := s.(FeaturedSshServer); ok {
+		features = featured.Features()
+	}
+	serveListener(s, listener, features)
+}
 
+// Accepts connections on listener and serves each of them with features until the listener is closed
+func serveListener(s SshServer, listener net.Listener, features ServerFeatures) {
 	for {
 		tcpConn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Errorf("Failed to accept incoming connection (%s)", err)
 			continue
@@ -121,10 +163,10 @@ func DefaultSshHandler(s SshServer) {
 		}
 
 		log.Infof("New SSH connection from %s (%s)", sshConn.RemoteAddr(), sshConn.ClientVersion())
-		// Discard all global out-of-band Requests
-		go ssh.DiscardRequests(reqs)
+		// Service port forwarding requests and reject all other global out-of-band Requests
+		go handleGlobalRequests(sshConn, reqs, features)
 		// Accept all channels
-		go handleChannels(chans)
+		go handleChannels(chans, features)
 	}
 }
 
@@ -248,10 +290,137 @@ func getAuthorizedKeys(keysPath string) ([]byte, error) {
 	return ioutil.ReadFile(keysPath)
 }
 
-func handleChannels(chans <-chan ssh.NewChannel) {
+func handleChannels(chans <-chan ssh.NewChannel, features ServerFeatures) {
 	// Service the incoming Channel channel in go routine
 	for newChannel := range chans {
-		go handleChannel(newChannel)
+		switch {
+		case newChannel.ChannelType() == "direct-tcpip" && !features.DirectTcpip:
+			newChannel.Reject(ssh.Prohibited, "direct-tcpip channels are not enabled on this server")
+		case newChannel.ChannelType() == "direct-tcpip":
+			go handleDirectTcpip(newChannel)
+		default:
+			go handleChannel(newChannel, features)
+		}
+	}
+}
+
+// directTcpipPayload is the extra data sent with a "direct-tcpip" channel open request (RFC 4254 section 7.2)
+type directTcpipPayload struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// Dials the host requested by a "direct-tcpip" channel and proxies the channel to it, rejecting the channel if
+// the host cannot be reached
+func handleDirectTcpip(newChannel ssh.NewChannel) {
+	var payload directTcpipPayload
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "could not parse direct-tcpip payload: "+err.Error())
+		return
+	}
+	target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	connection, requests, err := newChannel.Accept()
+	if err != nil {
+		log.Errorf("Could not accept channel (%s)", err)
+		target.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	proxy(connection, connection, target)
+	connection.Close()
+}
+
+// tcpipForwardPayload is the payload of "tcpip-forward" and "cancel-tcpip-forward" requests (RFC 4254 section 7.1)
+type tcpipForwardPayload struct {
+	Addr string
+	Port uint32
+}
+
+// forwardedTcpipPayload is the extra data sent with a "forwarded-tcpip" channel open request (RFC 4254 section 7.2)
+type forwardedTcpipPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// Handles the global requests of a single connection. If they are enabled, remote port forwards are opened for
+// "tcpip-forward" requests and stay open until they are cancelled or the connection is closed
+func handleGlobalRequests(conn *ssh.ServerConn, reqs <-chan *ssh.Request, features ServerFeatures) {
+	listeners := make(map[string]net.Listener)
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	for req := range reqs {
+		if !features.RemoteForward {
+			req.Reply(false, nil)
+			continue
+		}
+		switch req.Type {
+		case "tcpip-forward":
+			var payload tcpipForwardPayload
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			listener, err := net.Listen("tcp", net.JoinHostPort(payload.Addr, strconv.Itoa(int(payload.Port))))
+			if err != nil {
+				log.Errorf("Could not listen for remote forward (%s)", err)
+				req.Reply(false, nil)
+				continue
+			}
+			port := uint32(listener.Addr().(*net.TCPAddr).Port)
+			listeners[net.JoinHostPort(payload.Addr, strconv.Itoa(int(port)))] = listener
+			req.Reply(true, ssh.Marshal(struct{ Port uint32 }{port}))
+			go serveForwardedTcpip(conn, listener, payload.Addr, port)
+		case "cancel-tcpip-forward":
+			var payload tcpipForwardPayload
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			key := net.JoinHostPort(payload.Addr, strconv.Itoa(int(payload.Port)))
+			listener, ok := listeners[key]
+			if ok {
+				listener.Close()
+				delete(listeners, key)
+			}
+			req.Reply(ok, nil)
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// Opens a "forwarded-tcpip" channel back to the client for each connection accepted on a remote forward's listener
+func serveForwardedTcpip(conn *ssh.ServerConn, listener net.Listener, addr string, port uint32) {
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			origin := c.RemoteAddr().(*net.TCPAddr)
+			payload := forwardedTcpipPayload{Addr: addr, Port: port, OriginAddr: origin.IP.String(), OriginPort: uint32(origin.Port)}
+			channel, requests, err := conn.OpenChannel("forwarded-tcpip", ssh.Marshal(&payload))
+			if err != nil {
+				log.Errorf("Could not open forwarded-tcpip channel (%s)", err)
+				c.Close()
+				return
+			}
+			go ssh.DiscardRequests(requests)
+			proxy(channel, channel, c)
+			channel.Close()
+		}()
 	}
 }
 
@@ -277,7 +446,7 @@ func getDefaultHostKey() (ssh.Signer, error) {
 	return ssh.ParsePrivateKey(data)
 }
 
-func handleChannel(newChannel ssh.NewChannel) {
+func handleChannel(newChannel ssh.NewChannel, features ServerFeatures) {
 	// Since we're handling a shell, we expect a
 	// channel type of "session". This also describes
 	// "x11", "direct-tcpip" and "forwarded-tcpip"
@@ -295,62 +464,200 @@ func handleChannel(newChannel ssh.NewChannel) {
 		return
 	}
 
-	// Fire up bash for this session
+	// Sessions have out-of-band requests such as "shell", "exec", "pty-req" and "env"
+	var bashf *os.File
+	var w, h uint32
+	started := false
+	for req := range requests {
+		switch req.Type {
+		case "shell":
+			// We only accept the default shell
+			// (i.e. no command in the Payload)
+			if started || len(req.Payload) != 0 {
+				req.Reply(false, nil)
+				continue
+			}
+			started = true
+			req.Reply(true, nil)
+			bashf = startShell(connection, w, h)
+		case "exec":
+			var payload execPayload
+			if started || !features.Exec || ssh.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			started = true
+			req.Reply(true, nil)
+			startExec(connection, payload.Command)
+		case "subsystem":
+			var payload subsystemPayload
+			if started || !features.Sftp || ssh.Unmarshal(req.Payload, &payload) != nil || payload.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			started = true
+			req.Reply(true, nil)
+			go serveSftp(connection)
+		case "pty-req":
+			termLen := req.Payload[3]
+			w, h = parseDims(req.Payload[termLen+4:])
+			// Responding true (OK) here will let the client
+			// know we have a pty ready for input
+			req.Reply(true, nil)
+		case "window-change":
+			w, h = parseDims(req.Payload)
+			if bashf != nil {
+				SetWinsize(bashf.Fd(), w, h)
+			}
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// execPayload is the payload of an "exec" request (RFC 4254 section 6.5)
+type execPayload struct {
+	Command string
+}
+
+// subsystemPayload is the payload of a "subsystem" request (RFC 4254 section 6.5)
+type subsystemPayload struct {
+	Name string
+}
+
+// Serves the sftp subsystem on the session until the client ends it
+func serveSftp(connection ssh.Channel) {
+	server, err := sftp.NewServer(connection)
+	if err == nil {
+		err = server.Serve()
+	}
+	if err != nil && err != io.EOF {
+		log.Errorf("sftp server failed (%s)", err)
+	}
+	connection.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+	connection.Close()
+}
+
+// Fires up bash in a pty of the given size for this session and returns the pty
+func startShell(connection ssh.Channel, w, h uint32) *os.File {
 	bash := exec.Command("bash")
 
-	// Prepare teardown function
-	close := func() {
-		connection.Close()
-		_, err := bash.Process.Wait()
+	// Allocate a terminal for this channel. It is made bash's controlling terminal as its stdin, fd 0 in bash, rather
+	// than through pty.Start, which in some versions of the pty package passes the descriptor it has here instead
+	log.Infof("Creating pty...")
+	bashf, tty, err := pty.Open()
+	if err == nil {
+		bash.Stdin, bash.Stdout, bash.Stderr = tty, tty, tty
+		bash.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+		err = bash.Start()
+		tty.Close()
 		if err != nil {
-			log.Errorf("Failed to exit bash (%s)", err)
+			bashf.Close()
 		}
-		log.Infof("Session closed")
 	}
-
-	// Allocate a terminal for this channel
-	log.Infof("Creating pty...")
-	bashf, err := pty.Start(bash)
 	if err != nil {
 		log.Errorf("Could not start pty (%s)", err)
-		close()
-		return
+		exitSession(connection, nil)
+		return nil
+	}
+	if w > 0 && h > 0 {
+		SetWinsize(bashf.Fd(), w, h)
+	}
+
+	// Prepare teardown function
+	teardown := func() {
+		bashf.Close()
+		if err := bash.Wait(); err != nil {
+			log.Errorf("Failed to exit bash (%s)", err)
+		}
+		exitSession(connection, bash.ProcessState)
+		log.Infof("Session closed")
 	}
 
 	//pipe session to bash and visa-versa
 	var once sync.Once
 	go func() {
 		io.Copy(connection, bashf)
-		once.Do(close)
+		once.Do(teardown)
 	}()
 	go func() {
 		io.Copy(bashf, connection)
-		once.Do(close)
+		once.Do(teardown)
 	}()
+	return bashf
+}
 
-	// Sessions have out-of-band requests such as "shell", "pty-req" and "env"
+// Runs command with bash -c, without a pty, connecting its stdin, stdout and stderr to the session
+func startExec(connection ssh.Channel, command string) {
+	cmd := exec.Command("bash", "-c", command)
+	cmd.Stdout = connection
+	cmd.Stderr = connection.Stderr()
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		log.Errorf("Could not start command (%s)", err)
+		fmt.Fprintln(connection.Stderr(), err)
+		exitSession(connection, nil)
+		return
+	}
+
+	// stdin is copied separately so that cmd.Wait does not block on a client that never closes it
 	go func() {
-		for req := range requests {
-			switch req.Type {
-			case "shell":
-				// We only accept the default shell
-				// (i.e. no command in the Payload)
-				if len(req.Payload) == 0 {
-					req.Reply(true, nil)
-				}
-			case "pty-req":
-				termLen := req.Payload[3]
-				w, h := parseDims(req.Payload[termLen+4:])
-				SetWinsize(bashf.Fd(), w, h)
-				// Responding true (OK) here will let the client
-				// know we have a pty ready for input
-				req.Reply(true, nil)
-			case "window-change":
-				w, h := parseDims(req.Payload)
-				SetWinsize(bashf.Fd(), w, h)
-			}
-		}
+		io.Copy(stdin, connection)
+		stdin.Close()
 	}()
+	go func() {
+		cmd.Wait()
+		exitSession(connection, cmd.ProcessState)
+	}()
+}
+
+// exitSignalPayload is the payload of an "exit-signal" request (RFC 4254 section 6.10)
+type exitSignalPayload struct {
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Lang       string
+}
+
+// The signals that may be reported with "exit-signal", by their local numbers
+var exitSignals = map[syscall.Signal]ssh.Signal{
+	syscall.SIGABRT: ssh.SIGABRT,
+	syscall.SIGALRM: ssh.SIGALRM,
+	syscall.SIGFPE:  ssh.SIGFPE,
+	syscall.SIGHUP:  ssh.SIGHUP,
+	syscall.SIGILL:  ssh.SIGILL,
+	syscall.SIGINT:  ssh.SIGINT,
+	syscall.SIGKILL: ssh.SIGKILL,
+	syscall.SIGPIPE: ssh.SIGPIPE,
+	syscall.SIGQUIT: ssh.SIGQUIT,
+	syscall.SIGSEGV: ssh.SIGSEGV,
+	syscall.SIGTERM: ssh.SIGTERM,
+	syscall.SIGUSR1: ssh.SIGUSR1,
+	syscall.SIGUSR2: ssh.SIGUSR2,
+}
+
+// Reports how a session's process exited and closes the channel. A nil state means the process could not be
+// started, which is reported the way shells report a missing command
+func exitSession(connection ssh.Channel, state *os.ProcessState) {
+	defer connection.Close()
+	if state == nil {
+		connection.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{127}))
+		return
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		if signal, ok := exitSignals[ws.Signal()]; ok {
+			payload := exitSignalPayload{Signal: string(signal), CoreDumped: ws.CoreDump()}
+			connection.SendRequest("exit-signal", false, ssh.Marshal(&payload))
+			return
+		}
+		// shells report other signals as 128 + the signal number
+		connection.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{128 + uint32(ws.Signal())}))
+		return
+	}
+	connection.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(state.ExitCode())}))
 }
 
 // parseDims extracts terminal dimensions (width x height) from the provided buffer.
@@ -0,0 +1,150 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// RemoteFS is the filesystem of a remote machine, accessed with the sftp subsystem. Its methods mirror their
+// counterparts in package os, and missing files are reported with errors for which os.IsNotExist is true
+type RemoteFS struct {
+	client *sftp.Client
+}
+
+// Starts the sftp subsystem on conn and returns a RemoteFS using it. An error is returned if the server does not
+// support sftp. The RemoteFS should be closed once it is no longer needed, which leaves conn open
+func NewRemoteFS(conn *ssh.Client) (*RemoteFS, error) {
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteFS{client: client}, nil
+}
+
+// Runs f with a RemoteFS on conn and returns its error, or returns false without calling f if the server does not
+// support sftp so that the caller can fall back to running commands. The RemoteFS is closed if ctx is done first
+func withRemoteFS(ctx context.Context, conn *ssh.Client, f func(rfs *RemoteFS) error) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return true, err
+	}
+	rfs, err := NewRemoteFS(conn)
+	if err != nil {
+		return false, nil
+	}
+	defer rfs.Close()
+	return true, withContext(ctx, rfs, func() error {
+		return f(rfs)
+	})
+}
+
+// Converts errors for missing files into FileNotFound, for the helpers in client.go
+func sftpError(err error) error {
+	if os.IsNotExist(err) {
+		return FileNotFound
+	}
+	return err
+}
+
+// Ends the sftp session
+func (rfs *RemoteFS) Close() error {
+	return rfs.client.Close()
+}
+
+// Opens a remote file for reading
+func (rfs *RemoteFS) Open(name string) (*sftp.File, error) {
+	return rfs.client.Open(name)
+}
+
+// Creates or truncates a remote file and opens it for reading and writing
+func (rfs *RemoteFS) Create(name string) (*sftp.File, error) {
+	return rfs.client.Create(name)
+}
+
+// Opens a remote file with the given os.O_* flags
+func (rfs *RemoteFS) OpenFile(name string, flag int) (*sftp.File, error) {
+	return rfs.client.OpenFile(name, flag)
+}
+
+// Returns the entries of a remote directory
+func (rfs *RemoteFS) ReadDir(name string) ([]os.FileInfo, error) {
+	return rfs.client.ReadDir(name)
+}
+
+// Returns information about a remote file, following symbolic links
+func (rfs *RemoteFS) Stat(name string) (os.FileInfo, error) {
+	return rfs.client.Stat(name)
+}
+
+// Returns information about a remote file without following symbolic links
+func (rfs *RemoteFS) Lstat(name string) (os.FileInfo, error) {
+	return rfs.client.Lstat(name)
+}
+
+// Renames a remote file or directory
+func (rfs *RemoteFS) Rename(oldname, newname string) error {
+	return rfs.client.Rename(oldname, newname)
+}
+
+// Changes the permissions of a remote file
+func (rfs *RemoteFS) Chmod(name string, mode os.FileMode) error {
+	return rfs.client.Chmod(name, mode)
+}
+
+// Changes the access and modification times of a remote file
+func (rfs *RemoteFS) Chtimes(name string, atime, mtime time.Time) error {
+	return rfs.client.Chtimes(name, atime, mtime)
+}
+
+// Creates newname as a symbolic link to oldname
+func (rfs *RemoteFS) Symlink(oldname, newname string) error {
+	return rfs.client.Symlink(oldname, newname)
+}
+
+// Returns the target of a remote symbolic link
+func (rfs *RemoteFS) Readlink(name string) (string, error) {
+	return rfs.client.ReadLink(name)
+}
+
+// Creates a remote directory
+func (rfs *RemoteFS) Mkdir(name string) error {
+	return rfs.client.Mkdir(name)
+}
+
+// Creates a remote directory along with any missing parents
+func (rfs *RemoteFS) MkdirAll(name string) error {
+	return rfs.client.MkdirAll(name)
+}
+
+// Removes a remote file or empty directory
+func (rfs *RemoteFS) Remove(name string) error {
+	return rfs.client.Remove(name)
+}
+
+// Removes a remote directory, which must be empty. Unlike Remove, this fails if name is a file
+func (rfs *RemoteFS) RemoveDir(name string) error {
+	return rfs.client.RemoveDirectory(name)
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRemoteFS(t *testing.T) {
+	Convey("Given a connection to an in-process ssh server with sftp", t, func() {
+		_, conn := newTestConn(t)
+		dir, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+
+		Convey("Open a remote filesystem", func() {
+			rfs, err := NewRemoteFS(conn)
+			So(err, ShouldBeNil)
+
+			Convey("Create, stat and read back a file", func() {
+				name := filepath.Join(dir, "created")
+				f, err := rfs.Create(name)
+				So(err, ShouldBeNil)
+				_, err = f.Write([]byte(fileData))
+				So(err, ShouldBeNil)
+				So(f.Close(), ShouldBeNil)
+
+				info, err := rfs.Stat(name)
+				So(err, ShouldBeNil)
+				So(info.Size(), ShouldEqual, len(fileData))
+				So(info.IsDir(), ShouldBeFalse)
+
+				f, err = rfs.Open(name)
+				So(err, ShouldBeNil)
+				data, err := ioutil.ReadAll(f)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, fileData)
+				So(f.Close(), ShouldBeNil)
+			})
+
+			Convey("Rename, chmod, symlink and list files", func() {
+				So(ioutil.WriteFile(filepath.Join(dir, "a"), []byte(fileData), 0644), ShouldBeNil)
+				So(rfs.Rename(filepath.Join(dir, "a"), filepath.Join(dir, "b")), ShouldBeNil)
+				So(rfs.Chmod(filepath.Join(dir, "b"), 0600), ShouldBeNil)
+				So(rfs.Symlink(filepath.Join(dir, "b"), filepath.Join(dir, "link")), ShouldBeNil)
+
+				target, err := rfs.Readlink(filepath.Join(dir, "link"))
+				So(err, ShouldBeNil)
+				So(target, ShouldEqual, filepath.Join(dir, "b"))
+				info, err := rfs.Lstat(filepath.Join(dir, "link"))
+				So(err, ShouldBeNil)
+				So(info.Mode()&os.ModeSymlink, ShouldNotEqual, 0)
+
+				entries, err := rfs.ReadDir(dir)
+				So(err, ShouldBeNil)
+				names := []string{}
+				for _, e := range entries {
+					names = append(names, e.Name())
+				}
+				So(names, ShouldContain, "b")
+				So(names, ShouldContain, "link")
+				info, err = rfs.Stat(filepath.Join(dir, "b"))
+				So(err, ShouldBeNil)
+				So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+
+				So(rfs.Remove(filepath.Join(dir, "link")), ShouldBeNil)
+				So(rfs.Remove(filepath.Join(dir, "b")), ShouldBeNil)
+			})
+
+			Convey("Missing files should be reported as not existing", func() {
+				_, err := rfs.Stat(filepath.Join(dir, "missing"))
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+
+			Reset(func() {
+				rfs.Close()
+			})
+		})
+
+		Convey("Make and remove remote directories and files with the sftp backed helpers", func() {
+			name := filepath.Join(dir, "newdir")
+			So(MakeRemoteDir(conn, name), ShouldBeNil)
+			So(MakeRemoteDir(conn, name), ShouldEqual, FileExists)
+			So(DoesRemoteFileExist(conn, name), ShouldBeTrue)
+			So(RemoveRemoteDir(conn, name), ShouldBeNil)
+			So(RemoveRemoteDir(conn, name), ShouldEqual, FileNotFound)
+			So(DoesRemoteFileExist(conn, name), ShouldBeFalse)
+
+			So(Copy(conn, "file", dir, []byte(fileData)), ShouldBeNil)
+			So(RemoveRemoteFile(conn, filepath.Join(dir, "file")), ShouldBeNil)
+			So(RemoveRemoteFile(conn, filepath.Join(dir, "file")), ShouldEqual, FileNotFound)
+		})
+
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+	})
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// The TERM requested for a remote pty when neither ShellOptions nor the environment give one
+const defaultTerm = "xterm"
+
+// The signals which are forwarded to a remote shell when the local process receives them
+var forwardedSignals = map[os.Signal]ssh.Signal{
+	syscall.SIGINT:  ssh.SIGINT,
+	syscall.SIGQUIT: ssh.SIGQUIT,
+	syscall.SIGTERM: ssh.SIGTERM,
+	syscall.SIGHUP:  ssh.SIGHUP,
+	syscall.SIGUSR1: ssh.SIGUSR1,
+	syscall.SIGUSR2: ssh.SIGUSR2,
+}
+
+// ShellOptions configures an interactive session
+type ShellOptions struct {
+	// The command to run, or empty for the remote user's login shell
+	Command string
+	// The local terminal; os.Stdin, os.Stdout and os.Stderr when nil. A pty is only requested when Stdin is a
+	// terminal
+	Stdin  *os.File
+	Stdout io.Writer
+	Stderr io.Writer
+	// The TERM of the remote pty; $TERM, or xterm when it is not set, when empty
+	Term string
+}
+
+// Runs an interactive session attached to the local terminal. The terminal is put in raw mode for the session and
+// restored afterwards, a pty of the terminal's size is requested, and changes to the terminal's size and signals
+// received locally are sent to the remote end. The result holds how the remote command exited, like Run
+func Shell(conn *ssh.Client, options ShellOptions) (*Result, error) {
+	return ShellContext(context.Background(), conn, options)
+}
+
+// Runs an interactive session like Shell, closing it if ctx is done first
+func ShellContext(ctx context.Context, conn *ssh.Client, options ShellOptions) (*Result, error) {
+	if options.Stdin == nil {
+		options.Stdin = os.Stdin
+	}
+	if options.Stdout == nil {
+		options.Stdout = os.Stdout
+	}
+	if options.Stderr == nil {
+		options.Stderr = os.Stderr
+	}
+	if options.Term == "" {
+		options.Term = os.Getenv("TERM")
+	}
+	if options.Term == "" {
+		options.Term = defaultTerm
+	}
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	session.Stdin = options.Stdin
+	session.Stdout = options.Stdout
+	session.Stderr = options.Stderr
+
+	fd := int(options.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		width, height, err := term.GetSize(fd)
+		if err != nil {
+			return nil, err
+		}
+		modes := ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+		if err := session.RequestPty(options.Term, height, width, modes); err != nil {
+			return nil, err
+		}
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return nil, err
+		}
+		defer term.Restore(fd, state)
+
+		resized := make(chan os.Signal, 1)
+		signal.Notify(resized, syscall.SIGWINCH)
+		defer func() {
+			signal.Stop(resized)
+			close(resized)
+		}()
+		go func() {
+			for range resized {
+				if width, height, err := term.GetSize(fd); err == nil {
+					session.WindowChange(height, width)
+				}
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	for sig := range forwardedSignals {
+		signal.Notify(signals, sig)
+	}
+	defer func() {
+		signal.Stop(signals)
+		close(signals)
+	}()
+	go func() {
+		for sig := range signals {
+			session.Signal(forwardedSignals[sig])
+		}
+	}()
+
+	start := time.Now()
+	err = withContext(ctx, session, func() error {
+		if options.Command == "" {
+			if err := session.Shell(); err != nil {
+				return err
+			}
+			return session.Wait()
+		}
+		return session.Run(options.Command)
+	})
+	return newResult(options.Command, nil, nil, time.Since(start), err)
+}
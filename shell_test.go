@@ -0,0 +1,123 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/term"
+)
+
+// testTerminal records everything written to a local pty's terminal
+type testTerminal struct {
+	ptmx, tty *os.File
+
+	mu     sync.Mutex
+	output bytes.Buffer
+}
+
+func (t *testTerminal) read() {
+	buf := make([]byte, 1024)
+	for {
+		n, err := t.ptmx.Read(buf)
+		t.mu.Lock()
+		t.output.Write(buf[:n])
+		t.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (t *testTerminal) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.output.String()
+}
+
+func TestShell(t *testing.T) {
+	// ptys can't be opened everywhere, such as in some containers
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("Can't open a pty (%s)", err)
+	}
+	ptmx.Close()
+	tty.Close()
+
+	Convey("Given a connection to an ssh server and a local terminal", t, func() {
+		_, conn := newTestConn(t)
+		ptmx, tty, err := pty.Open()
+		So(err, ShouldBeNil)
+		So(pty.Setsize(tty, &pty.Winsize{Rows: 30, Cols: 100}), ShouldBeNil)
+		terminal := &testTerminal{ptmx: ptmx, tty: tty}
+		go terminal.read()
+		options := ShellOptions{Stdin: tty, Stdout: tty, Stderr: tty}
+
+		Convey("The shell should get a pty of the terminal's size and exit with the remote status", func() {
+			before, err := term.GetState(int(tty.Fd()))
+			So(err, ShouldBeNil)
+			_, err = ptmx.Write([]byte("stty size; exit 7\n"))
+			So(err, ShouldBeNil)
+			result, err := Shell(conn, options)
+			var cmdErr *CommandError
+			So(errors.As(err, &cmdErr), ShouldBeTrue)
+			So(result.ExitStatus, ShouldEqual, 7)
+			So(terminal.String(), ShouldContainSubstring, "30 100")
+
+			// the terminal is no longer raw
+			after, err := term.GetState(int(tty.Fd()))
+			So(err, ShouldBeNil)
+			So(after, ShouldResemble, before)
+		})
+
+		Convey("Resizing the terminal should resize the remote pty", func() {
+			done := make(chan error, 1)
+			go func() {
+				_, err := Shell(conn, options)
+				done <- err
+			}()
+			// the prompt shows that the shell has started
+			for start := time.Now(); terminal.String() == "" && time.Since(start) < 5*time.Second; {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(pty.Setsize(tty, &pty.Winsize{Rows: 40, Cols: 120}), ShouldBeNil)
+			So(syscall.Kill(os.Getpid(), syscall.SIGWINCH), ShouldBeNil)
+			time.Sleep(300 * time.Millisecond)
+			_, err = ptmx.Write([]byte("stty size; exit\n"))
+			So(err, ShouldBeNil)
+			So(<-done, ShouldBeNil)
+			So(terminal.String(), ShouldContainSubstring, "40 120")
+		})
+
+		Reset(func() {
+			tty.Close()
+			ptmx.Close()
+		})
+	})
+}
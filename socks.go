@@ -0,0 +1,273 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"sessionm/shared/log"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SOCKS protocol constants (RFC 1928 for version 5, and the SOCKS4/4a protocol documents for version 4)
+const (
+	socks4Version = 0x04
+	socks5Version = 0x05
+
+	socksConnect = 0x01
+
+	socks5NoAuth       = 0x00
+	socks5NoAcceptable = 0xff
+
+	socks5IPv4   = 0x01
+	socks5Domain = 0x03
+	socks5IPv6   = 0x04
+
+	socks5Succeeded           = 0x00
+	socks5GeneralFailure      = 0x01
+	socks5CommandNotSupported = 0x07
+	socks5AddressNotSupported = 0x08
+
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+)
+
+// errors
+var (
+	SocksVersionNotSupported = errors.New("Unsupported SOCKS version")
+	SocksCommandNotSupported = errors.New("Only the SOCKS CONNECT command is supported")
+	SocksAuthNotSupported    = errors.New("The SOCKS client does not support unauthenticated connections")
+	SocksAddressNotSupported = errors.New("Unsupported SOCKS address type")
+)
+
+// SocksProxy is a SOCKS5 and SOCKS4a server which makes every CONNECT request from the remote end of an ssh
+// connection, like ssh -D. Only unauthenticated CONNECT requests are supported
+type SocksProxy struct {
+	// Dial opens the outgoing connection for each request. NewSocksProxy sets it to the ssh client's Dial
+	Dial func(network, addr string) (net.Conn, error)
+}
+
+// Returns a SocksProxy that dials through conn
+func NewSocksProxy(conn *ssh.Client) *SocksProxy {
+	return &SocksProxy{Dial: conn.Dial}
+}
+
+// Starts a SOCKS proxy listening on url which dials through conn. This blocks until the listener fails
+func StartSocksProxy(conn *ssh.Client, url string) error {
+	listener, err := net.Listen("tcp", url)
+	if err != nil {
+		return err
+	}
+	log.Infof("[*] SOCKS proxy listening on %s...\n", url)
+	return NewSocksProxy(conn).Serve(listener)
+}
+
+// Serves SOCKS requests on listener until it fails. The listener is closed when this returns
+func (p *SocksProxy) Serve(listener net.Listener) error {
+	defer listener.Close()
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		go func() {
+			if err := p.ServeConn(c); err != nil {
+				log.Errorf("[%s] %s", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Negotiates a single SOCKS request on c and proxies it to its destination, closing c when either side is done
+func (p *SocksProxy) ServeConn(c net.Conn) error {
+	defer c.Close()
+	var version [1]byte
+	if _, err := io.ReadFull(c, version[:]); err != nil {
+		return err
+	}
+
+	// reply reports the outcome of the request, using the SOCKS5 reply codes for both versions
+	var addr string
+	var err error
+	var reply func(code byte) error
+	switch version[0] {
+	case socks5Version:
+		reply = func(code byte) error {
+			// the bound address is not known on the remote end, so it is always reported as 0.0.0.0:0
+			_, err := c.Write([]byte{socks5Version, code, 0x00, socks5IPv4, 0, 0, 0, 0, 0, 0})
+			return err
+		}
+		addr, err = readSocks5Request(c)
+		if err == SocksCommandNotSupported {
+			reply(socks5CommandNotSupported)
+		} else if err == SocksAddressNotSupported {
+			reply(socks5AddressNotSupported)
+		}
+	case socks4Version:
+		reply = func(code byte) error {
+			status := byte(socks4Rejected)
+			if code == socks5Succeeded {
+				status = socks4Granted
+			}
+			_, err := c.Write([]byte{0x00, status, 0, 0, 0, 0, 0, 0})
+			return err
+		}
+		addr, err = readSocks4Request(c)
+		if err == SocksCommandNotSupported {
+			reply(socks5CommandNotSupported)
+		}
+	default:
+		return SocksVersionNotSupported
+	}
+	if err != nil {
+		return err
+	}
+
+	remote, err := p.Dial("tcp", addr)
+	if err != nil {
+		reply(socks5GeneralFailure)
+		return fmt.Errorf("Could not connect to %s (%s)", addr, err)
+	}
+	defer remote.Close()
+	if err := reply(socks5Succeeded); err != nil {
+		return err
+	}
+	log.Infof("[%s] Proxying to %s", c.RemoteAddr(), addr)
+	return proxy(remote, remote, c)
+}
+
+// Reads a SOCKS5 method negotiation and request, after the version byte, and returns the requested host:port
+func readSocks5Request(c net.Conn) (string, error) {
+	var nMethods [1]byte
+	if _, err := io.ReadFull(c, nMethods[:]); err != nil {
+		return "", err
+	}
+	methods := make([]byte, nMethods[0])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return "", err
+	}
+	method := byte(socks5NoAcceptable)
+	for _, m := range methods {
+		if m == socks5NoAuth {
+			method = socks5NoAuth
+		}
+	}
+	if _, err := c.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5NoAcceptable {
+		return "", SocksAuthNotSupported
+	}
+
+	// VER CMD RSV ATYP
+	var header [4]byte
+	if _, err := io.ReadFull(c, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", SocksVersionNotSupported
+	}
+
+	var host string
+	switch header[3] {
+	case socks5IPv4, socks5IPv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socks5IPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5Domain:
+		var length [1]byte
+		if _, err := io.ReadFull(c, length[:]); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(c, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", SocksAddressNotSupported
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(c, port[:]); err != nil {
+		return "", err
+	}
+	if header[1] != socksConnect {
+		return "", SocksCommandNotSupported
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// Reads a SOCKS4 or SOCKS4a request, after the version byte, and returns the requested host:port
+func readSocks4Request(c net.Conn) (string, error) {
+	// CMD DSTPORT DSTIP
+	var header [7]byte
+	if _, err := io.ReadFull(c, header[:]); err != nil {
+		return "", err
+	}
+	// the user id is ignored
+	if _, err := readNullTerminated(c); err != nil {
+		return "", err
+	}
+
+	ip := net.IP(header[3:7])
+	host := ip.String()
+	// SOCKS4a signals that a domain name follows the user id with an address of 0.0.0.x, where x is non-zero
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		domain, err := readNullTerminated(c)
+		if err != nil {
+			return "", err
+		}
+		host = domain
+	}
+	if header[0] != socksConnect {
+		return "", SocksCommandNotSupported
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(header[1:3])))), nil
+}
+
+// Reads a null terminated string of at most 255 bytes one byte at a time, so that nothing past it is consumed
+func readNullTerminated(r io.Reader) (string, error) {
+	var buf []byte
+	var b [1]byte
+	for len(buf) < 256 {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		buf = append(buf, b[0])
+	}
+	return "", errors.New("SOCKS string is too long")
+}
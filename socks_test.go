@@ -0,0 +1,103 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSocksProxy(t *testing.T) {
+	Convey("Given a SOCKS proxy dialing through an in-process ssh server", t, func() {
+		_, conn := newTestConn(t)
+		echo, err := startEchoServer()
+		So(err, ShouldBeNil)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		go NewSocksProxy(conn).Serve(listener)
+		_, port := splitTestAddr(echo.Addr())
+		portBytes := make([]byte, 2)
+		binary.BigEndian.PutUint16(portBytes, uint16(port))
+
+		c, err := net.Dial("tcp", listener.Addr().String())
+		So(err, ShouldBeNil)
+
+		Convey("A SOCKS5 CONNECT to a domain name should reach the echo server", func() {
+			_, err := c.Write([]byte{0x05, 0x01, 0x00})
+			So(err, ShouldBeNil)
+			So(readTestBytes(c, 2), ShouldResemble, []byte{0x05, 0x00})
+
+			request := append([]byte{0x05, 0x01, 0x00, 0x03, byte(len("localhost"))}, "localhost"...)
+			_, err = c.Write(append(request, portBytes...))
+			So(err, ShouldBeNil)
+			So(readTestBytes(c, 10)[1], ShouldEqual, 0x00)
+			So(echoTest(c), ShouldEqual, fileData)
+		})
+
+		Convey("A SOCKS5 BIND request should be rejected", func() {
+			_, err := c.Write([]byte{0x05, 0x01, 0x00})
+			So(err, ShouldBeNil)
+			So(readTestBytes(c, 2), ShouldResemble, []byte{0x05, 0x00})
+
+			_, err = c.Write(append([]byte{0x05, 0x02, 0x00, 0x01, 127, 0, 0, 1}, portBytes...))
+			So(err, ShouldBeNil)
+			So(readTestBytes(c, 10)[1], ShouldEqual, 0x07)
+		})
+
+		Convey("A SOCKS4a CONNECT to a domain name should reach the echo server", func() {
+			request := append([]byte{0x04, 0x01}, portBytes...)
+			request = append(request, 0, 0, 0, 1, 'u', 0)
+			request = append(request, "localhost"...)
+			_, err := c.Write(append(request, 0))
+			So(err, ShouldBeNil)
+			So(readTestBytes(c, 8)[1], ShouldEqual, 0x5a)
+			So(echoTest(c), ShouldEqual, fileData)
+		})
+
+		Reset(func() {
+			c.Close()
+			listener.Close()
+			echo.Close()
+		})
+	})
+}
+
+func readTestBytes(r io.Reader, n int) []byte {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	So(err, ShouldBeNil)
+	return buf
+}
+
+// Writes fileData to c, half-closes it and returns everything read back
+func echoTest(c net.Conn) string {
+	_, err := c.Write([]byte(fileData))
+	So(err, ShouldBeNil)
+	So(c.(*net.TCPConn).CloseWrite(), ShouldBeNil)
+	data, err := ioutil.ReadAll(c)
+	So(err, ShouldBeNil)
+	return string(data)
+}
@@ -24,7 +24,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -131,6 +133,106 @@ func TestSsh(t *testing.T) {
 	})
 }
 
+func TestStatRemoteFile(t *testing.T) {
+	for _, stat := range []struct {
+		name     string
+		features ServerFeatures
+	}{
+		{"the stat command", ServerFeatures{Exec: true, Sftp: true}},
+		{"the stat command without sftp", ServerFeatures{Exec: true}},
+		{"sftp when commands can't be run", ServerFeatures{Sftp: true}},
+	} {
+		Convey("Given a connection to an in-process ssh server using "+stat.name, t, func() {
+			server, err := startTestServerWithFeatures(newTestPublicKeyServer(), stat.features)
+			So(err, ShouldBeNil)
+			config, err := testClientConfig()
+			So(err, ShouldBeNil)
+			conn, err := GetSshConn(server.Addr().String(), config)
+			So(err, ShouldBeNil)
+			dir, err := ioutil.TempDir("", "")
+			So(err, ShouldBeNil)
+
+			Convey("Stat a file", func() {
+				name := filepath.Join(dir, "it's a file; echo $HOME")
+				So(ioutil.WriteFile(name, []byte(fileData), 0640), ShouldBeNil)
+				So(os.Chmod(name, 0640|os.ModeSetgid), ShouldBeNil)
+				mtime := time.Unix(1136214245, 0)
+				So(os.Chtimes(name, mtime, mtime), ShouldBeNil)
+
+				info, err := StatRemoteFile(conn, name)
+				So(err, ShouldBeNil)
+				So(info.Size(), ShouldEqual, len(fileData))
+				So(info.Mode(), ShouldEqual, 0640|os.ModeSetgid)
+				So(info.ModTime().Equal(mtime), ShouldBeTrue)
+				So(info.Uid, ShouldEqual, os.Getuid())
+				if stat.features.Exec {
+					So(info.Owner, ShouldEqual, CurrentUser)
+					So(info.Links, ShouldEqual, 1)
+					So(info.Inode, ShouldNotEqual, 0)
+				} else {
+					// sftp does not report them
+					So(info.Owner, ShouldEqual, "")
+					So(info.Inode, ShouldEqual, 0)
+				}
+			})
+
+			Convey("Stat a directory and a symbolic link", func() {
+				So(os.Symlink(dir, filepath.Join(dir, "link")), ShouldBeNil)
+
+				info, err := StatRemoteFile(conn, dir)
+				So(err, ShouldBeNil)
+				So(info.IsDir(), ShouldBeTrue)
+
+				info, err = StatRemoteFile(conn, filepath.Join(dir, "link"))
+				So(err, ShouldBeNil)
+				So(info.Name(), ShouldEqual, "link")
+				So(info.Mode()&os.ModeSymlink, ShouldNotEqual, 0)
+				So(info.LinkTarget, ShouldEqual, dir)
+			})
+
+			Convey("A missing file should return FileNotFound", func() {
+				_, err := StatRemoteFile(conn, filepath.Join(dir, "missing"))
+				So(err, ShouldEqual, FileNotFound)
+			})
+
+			Reset(func() {
+				os.RemoveAll(dir)
+				conn.Close()
+				server.Close()
+			})
+		})
+	}
+}
+
+func TestServerFeatures(t *testing.T) {
+	Convey("Given a server with no optional features enabled", t, func() {
+		listener, err := startTestServerWithFeatures(newTestPublicKeyServer(), ServerFeatures{})
+		So(err, ShouldBeNil)
+		config, err := testClientConfig()
+		So(err, ShouldBeNil)
+		conn, err := GetSshConn(listener.Addr().String(), config)
+		So(err, ShouldBeNil)
+
+		Convey("Commands, sftp, direct-tcpip channels and remote forwards should be refused", func() {
+			session, err := conn.NewSession()
+			So(err, ShouldBeNil)
+			So(session.Run("true"), ShouldNotBeNil)
+			session, err = conn.NewSession()
+			So(err, ShouldBeNil)
+			So(session.RequestSubsystem("sftp"), ShouldNotBeNil)
+			_, err = conn.Dial("tcp", listener.Addr().String())
+			So(err, ShouldNotBeNil)
+			_, err = conn.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldNotBeNil)
+		})
+
+		Reset(func() {
+			conn.Close()
+			listener.Close()
+		})
+	})
+}
+
 func createTestFile() (*os.File, error) {
 
 	dir, err := ioutil.TempDir("", "")
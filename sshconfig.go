@@ -0,0 +1,613 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The maximum depth of nested Include directives, as in ssh
+const maxIncludeDepth = 16
+
+// errors
+var (
+	UnterminatedConfigQuote = errors.New("Unterminated quote in ssh_config")
+)
+
+// The ssh_config options for which every value applies, rather than only the first one found
+var multiValueOptions = map[string]bool{
+	"identityfile":    true,
+	"certificatefile": true,
+	"localforward":    true,
+	"remoteforward":   true,
+	"dynamicforward":  true,
+}
+
+// SshConfig is a parsed OpenSSH client configuration (ssh_config). As with ssh, the first value found for an option
+// in the Host and Match blocks matching a host is the one used, so specific blocks must come before wildcard ones
+type SshConfig struct {
+	blocks []*sshConfigBlock
+}
+
+// sshConfigBlock holds the options of a Host or Match block, or of the lines before the first Host in a file
+type sshConfigBlock struct {
+	// the block containing the Include which this block was read from, which must also match
+	parent  *sshConfigBlock
+	hosts   []string
+	match   []matchCriterion
+	options []sshConfigOption
+}
+
+type sshConfigOption struct {
+	// the lower case option name
+	key    string
+	values []string
+}
+
+// matchCriterion is one criterion of a Match line, such as "host *.internal" or "!user root"
+type matchCriterion struct {
+	name   string
+	arg    string
+	negate bool
+}
+
+// The state of a host being resolved, which Host and Match blocks are checked against
+type matchContext struct {
+	originalHost string
+	host         string
+	user         string
+}
+
+// HostConfig is the configuration for connecting to a host, resolved from ssh_config
+type HostConfig struct {
+	// The host name as given, before ssh_config was applied
+	Alias    string
+	HostName string
+	Port     int
+	User     string
+	// The private keys to offer; DefaultPrivateKeyPaths are used when empty. Keys which do not exist are skipped
+	IdentityFiles []string
+	// Only offer IdentityFiles, and not the keys held by an ssh-agent
+	IdentitiesOnly bool
+	// The ProxyJump hosts, as [user@]host[:port] separated by commas, or empty for a direct connection
+	ProxyJump      string
+	KnownHostsPath string
+	HostKeyPolicy  HostKeyPolicy
+	// The timeout for establishing the connection, or 0 for none
+	ConnectTimeout time.Duration
+	// The ServerAliveInterval and ServerAliveCountMax used by a ManagedClient, or 0 for its defaults
+	KeepaliveInterval time.Duration
+	KeepaliveCountMax int
+	// The socket of a ControlMaster for the host, which connections are made through while it is running, or empty
+	// to always connect directly
+	ControlPath string
+
+	// ControlPath before it was expanded, so that it can be expanded again if the host is changed
+	controlPath string
+	// the config and inventory which ProxyJump hosts are resolved with
+	sshConfig *SshConfig
+	inventory *Inventory
+}
+
+// HostResolver returns the configuration for a [user@]host[:port] target, as SshConfig and Inventory do
+type HostResolver interface {
+	ResolveTarget(target string) (*HostConfig, error)
+}
+
+// Reads and parses the ssh_config files at paths, in order of precedence. Files which do not exist are skipped
+func LoadSshConfig(paths ...string) (*SshConfig, error) {
+	c := &SshConfig{}
+	for _, p := range paths {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			continue
+		}
+		if err := c.parseFile(p, filepath.Dir(p), nil, 0); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Parses an ssh_config file, appending its blocks. Relative Include paths are relative to includeDir
+func (c *SshConfig) parseFile(path, includeDir string, parent *sshConfigBlock, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s: Include nested too deeply", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// the lines before the first Host apply wherever the file is included
+	block := &sshConfigBlock{parent: parent}
+	c.blocks = append(c.blocks, block)
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		keyword, args, err := splitConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, lineNumber, err)
+		}
+		if keyword == "" {
+			continue
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("%s:%d: Missing argument for %s", path, lineNumber, keyword)
+		}
+		switch keyword {
+		case "host":
+			block = &sshConfigBlock{parent: parent, hosts: args}
+			c.blocks = append(c.blocks, block)
+		case "match":
+			criteria, err := parseMatch(args)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %s", path, lineNumber, err)
+			}
+			block = &sshConfigBlock{parent: parent, match: criteria}
+			c.blocks = append(c.blocks, block)
+		case "include":
+			for _, pattern := range args {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(includeDir, pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return fmt.Errorf("%s:%d: %s", path, lineNumber, err)
+				}
+				for _, match := range matches {
+					if err := c.parseFile(match, includeDir, block, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+			// the options after the Include come after the included ones
+			block = &sshConfigBlock{parent: block.parent, hosts: block.hosts, match: block.match}
+			c.blocks = append(c.blocks, block)
+		default:
+			block.options = append(block.options, sshConfigOption{key: keyword, values: args})
+		}
+	}
+	return scanner.Err()
+}
+
+// Splits an ssh_config line into its lower case keyword and arguments. Arguments may be double quoted, and the keyword
+// may be separated from them by "=". An empty keyword is returned for blank lines and comments
+func splitConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = rest[1:]
+	}
+
+	var args []string
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" || rest[0] == '#' {
+			return keyword, args, nil
+		}
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", nil, UnterminatedConfigQuote
+			}
+			args = append(args, rest[1:end+1])
+			rest = rest[end+2:]
+			continue
+		}
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			end = len(rest)
+		}
+		args = append(args, rest[:end])
+		rest = rest[end:]
+	}
+}
+
+// Parses the criteria of a Match line
+func parseMatch(args []string) ([]matchCriterion, error) {
+	var criteria []matchCriterion
+	for i := 0; i < len(args); i++ {
+		criterion := matchCriterion{name: strings.ToLower(args[i])}
+		if strings.HasPrefix(criterion.name, "!") {
+			criterion.name, criterion.negate = criterion.name[1:], true
+		}
+		switch criterion.name {
+		case "all", "canonical", "final":
+		case "host", "originalhost", "user", "localuser", "exec", "localnetwork", "tagged":
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("Missing argument for Match %s", criterion.name)
+			}
+			i++
+			criterion.arg = args[i]
+		default:
+			return nil, fmt.Errorf("Unsupported Match criteria %q", args[i])
+		}
+		criteria = append(criteria, criterion)
+	}
+	return criteria, nil
+}
+
+// Whether the block, and the blocks it was included from, apply
+func (b *sshConfigBlock) matches(ctx *matchContext) bool {
+	if b.parent != nil && !b.parent.matches(ctx) {
+		return false
+	}
+	if b.hosts != nil {
+		return matchPatternList(b.hosts, ctx.originalHost)
+	}
+	for _, criterion := range b.match {
+		if criterion.matches(ctx) == criterion.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether the criterion is met. Commands are never run, so exec, and the unsupported localnetwork and tagged
+// criteria, never match
+func (m matchCriterion) matches(ctx *matchContext) bool {
+	switch m.name {
+	case "all", "canonical", "final":
+		return true
+	case "host":
+		return matchPatternList(strings.Split(m.arg, ","), ctx.host)
+	case "originalhost":
+		return matchPatternList(strings.Split(m.arg, ","), ctx.originalHost)
+	case "user":
+		return matchPatternList(strings.Split(m.arg, ","), ctx.user)
+	case "localuser":
+		return matchPatternList(strings.Split(m.arg, ","), CurrentUser)
+	}
+	return false
+}
+
+// Whether s matches any of the patterns and none of the negated (!) ones. Host names are not case sensitive
+func matchPatternList(patterns []string, s string) bool {
+	s = strings.ToLower(s)
+	matched := false
+	for _, pattern := range patterns {
+		negate := strings.HasPrefix(pattern, "!")
+		if negate {
+			pattern = pattern[1:]
+		}
+		if matchPattern(strings.ToLower(pattern), s) {
+			if negate {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// Whether s matches pattern, where * matches any characters and ? matches exactly one
+func matchPattern(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// Returns the configuration for host, which may be an alias defined by a Host block
+func (c *SshConfig) Resolve(host string) (*HostConfig, error) {
+	return c.resolve(host, "")
+}
+
+// Returns the configuration for a [user@]host[:port] target. The user and port given in target take precedence over
+// the ones in the config
+func (c *SshConfig) ResolveTarget(target string) (*HostConfig, error) {
+	user, host, port, err := splitTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	h, err := c.resolve(host, user)
+	if err != nil {
+		return nil, err
+	}
+	if port != 0 {
+		h.Port = port
+		h.ControlPath = h.expandPath(h.controlPath)
+	}
+	return h, nil
+}
+
+// Resolves a [user@]host[:port] target using the ssh_config files at DefaultSshConfigPaths
+func ResolveHost(target string) (*HostConfig, error) {
+	config, err := LoadSshConfig(DefaultSshConfigPaths...)
+	if err != nil {
+		return nil, err
+	}
+	return config.ResolveTarget(target)
+}
+
+// Splits a [user@]host[:port] target. The port is 0 if not given
+func splitTarget(target string) (string, string, int, error) {
+	var user string
+	if i := strings.LastIndex(target, "@"); i >= 0 {
+		user, target = target[:i], target[i+1:]
+	}
+	if !strings.Contains(target, ":") || strings.Count(target, ":") > 1 && !strings.HasPrefix(target, "[") {
+		return user, target, 0, nil
+	}
+	host, portString, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", "", 0, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("Bad port %q", portString)
+	}
+	return user, host, port, nil
+}
+
+// Applies the matching blocks to host. If user is not empty it is used instead of the configured User
+func (c *SshConfig) resolve(host, user string) (*HostConfig, error) {
+	ctx := &matchContext{originalHost: host, host: host, user: user}
+	if user == "" {
+		ctx.user = CurrentUser
+	}
+	values := make(map[string][]string)
+	var identityFiles []string
+	for _, block := range c.blocks {
+		if !block.matches(ctx) {
+			continue
+		}
+		for _, option := range block.options {
+			if option.key == "identityfile" {
+				identityFiles = append(identityFiles, option.values[0])
+			}
+			if _, ok := values[option.key]; ok || multiValueOptions[option.key] {
+				continue
+			}
+			values[option.key] = option.values
+			// later Match blocks see the host name and user set so far
+			if option.key == "hostname" {
+				ctx.host = strings.Replace(option.values[0], "%h", host, -1)
+			} else if option.key == "user" && user == "" {
+				ctx.user = option.values[0]
+			}
+		}
+	}
+
+	h := &HostConfig{
+		Alias:          host,
+		HostName:       ctx.host,
+		Port:           22,
+		User:           ctx.user,
+		KnownHostsPath: DefaultKnownHostsPath,
+		HostKeyPolicy:  DefaultHostKeyPolicy,
+		sshConfig:      c,
+	}
+	if port, ok := values["port"]; ok {
+		p, err := strconv.Atoi(port[0])
+		if err != nil || p <= 0 || p > 65535 {
+			return nil, fmt.Errorf("Bad port %q for %s in ssh_config", port[0], host)
+		}
+		h.Port = p
+	}
+	if jump, ok := values["proxyjump"]; ok && strings.ToLower(jump[0]) != "none" {
+		h.ProxyJump = jump[0]
+	}
+	if only, ok := values["identitiesonly"]; ok {
+		h.IdentitiesOnly = strings.ToLower(only[0]) == "yes"
+	}
+	if checking, ok := values["stricthostkeychecking"]; ok {
+		policy, err := parseStrictHostKeyChecking(checking[0])
+		if err != nil {
+			return nil, err
+		}
+		h.HostKeyPolicy = policy
+	}
+	if knownHosts, ok := values["userknownhostsfile"]; ok {
+		h.KnownHostsPath = h.expandPath(knownHosts[0])
+	}
+	if timeout, ok := values["connecttimeout"]; ok {
+		seconds, err := strconv.Atoi(timeout[0])
+		if err != nil {
+			return nil, fmt.Errorf("Bad ConnectTimeout %q for %s in ssh_config", timeout[0], host)
+		}
+		h.ConnectTimeout = time.Duration(seconds) * time.Second
+	}
+	if interval, ok := values["serveraliveinterval"]; ok {
+		seconds, err := strconv.Atoi(interval[0])
+		if err != nil {
+			return nil, fmt.Errorf("Bad ServerAliveInterval %q for %s in ssh_config", interval[0], host)
+		}
+		h.KeepaliveInterval = time.Duration(seconds) * time.Second
+	}
+	if countMax, ok := values["serveralivecountmax"]; ok {
+		count, err := strconv.Atoi(countMax[0])
+		if err != nil {
+			return nil, fmt.Errorf("Bad ServerAliveCountMax %q for %s in ssh_config", countMax[0], host)
+		}
+		h.KeepaliveCountMax = count
+	}
+	for _, identityFile := range identityFiles {
+		h.IdentityFiles = append(h.IdentityFiles, h.expandPath(identityFile))
+	}
+	h.controlPath = DefaultControlPath
+	if controlPath, ok := values["controlpath"]; ok {
+		h.controlPath = controlPath[0]
+		if strings.ToLower(controlPath[0]) == "none" {
+			h.controlPath = ""
+		}
+	}
+	h.ControlPath = h.expandPath(h.controlPath)
+	return h, nil
+}
+
+// Maps StrictHostKeyChecking to a host key policy. "no" does not allow changed keys as it does in ssh
+func parseStrictHostKeyChecking(value string) (HostKeyPolicy, error) {
+	switch strings.ToLower(value) {
+	case "yes", "ask":
+		return HostKeyStrict, nil
+	case "accept-new":
+		return HostKeyTrustOnFirstUse, nil
+	case "no", "off":
+		return HostKeyInsecure, nil
+	}
+	return HostKeyStrict, fmt.Errorf("Unsupported StrictHostKeyChecking %q", value)
+}
+
+// Expands a leading ~ and the %C, %d, %h, %n, %p, %r, %u and %% tokens of a path in ssh_config
+func (h *HostConfig) expandPath(p string) string {
+	p = expandHome(p)
+	hash := sha1.Sum([]byte(h.User + "@" + h.Addr()))
+	replacer := strings.NewReplacer(
+		"%%", "%",
+		"%C", hex.EncodeToString(hash[:]),
+		"%d", homeDir,
+		"%h", h.HostName,
+		"%n", h.Alias,
+		"%p", strconv.Itoa(h.Port),
+		"%r", h.User,
+		"%u", CurrentUser,
+	)
+	return replacer.Replace(p)
+}
+
+// Replaces a leading ~ in a path with the current user's home directory
+func expandHome(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		return homeDir + p[1:]
+	}
+	return p
+}
+
+// Returns the host:port to dial
+func (h *HostConfig) Addr() string {
+	return net.JoinHostPort(h.HostName, strconv.Itoa(h.Port))
+}
+
+// Returns a client config which authenticates as User with the ssh-agent's keys and IdentityFiles, and verifies the
+// host key against KnownHostsPath with HostKeyPolicy
+func (h *HostConfig) ClientConfig() (*ssh.ClientConfig, error) {
+	// like ssh, the default keys which can't be used are skipped, while named ones are an error
+	keyPaths := h.IdentityFiles
+	defaultKeys := len(keyPaths) == 0
+	if defaultKeys {
+		keyPaths = DefaultPrivateKeyPaths
+	}
+	fileSigners, err := privateKeySigners(existingFiles(keyPaths), defaultKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	var auth ssh.AuthMethod
+	if h.IdentitiesOnly {
+		auth = ssh.PublicKeys(fileSigners...)
+	} else {
+		if len(fileSigners) == 0 && !agentAvailable() {
+			return nil, NoPrivateKey
+		}
+		auth = agentAndKeysAuth(fileSigners)
+	}
+
+	knownHosts, err := NewKnownHosts(h.KnownHostsPath, h.HostKeyPolicy)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ClientConfig{User: h.User, Auth: []ssh.AuthMethod{auth}, Timeout: h.ConnectTimeout}
+	return knownHosts.ClientConfig(config, h.Addr()), nil
+}
+
+// Connects to the host, through its control master if one is running on ControlPath, and otherwise through its
+// ProxyJump hosts if it has any
+func (h *HostConfig) Dial() (*ssh.Client, error) {
+	return h.DialContext(context.Background())
+}
+
+// Returns a ManagedClient connected to the host, which sends keepalives every KeepaliveInterval and redials the
+// connection when it is lost. The keys are loaded once, so that passphrases are not asked for again when redialing
+func (h *HostConfig) DialManaged() (*ManagedClient, error) {
+	var hops []Hop
+	return NewManagedClient(func(ctx context.Context) (*ssh.Client, error) {
+		if client, err := h.dialControl(ctx); err == nil {
+			return client, nil
+		}
+		if hops == nil {
+			var err error
+			if hops, err = h.Hops(); err != nil {
+				return nil, err
+			}
+		}
+		return DialChainContext(ctx, hops...)
+	}, h.KeepaliveInterval, h.KeepaliveCountMax)
+}
+
+// Connects to the host like Dial, giving up if ctx is done first
+func (h *HostConfig) DialContext(ctx context.Context) (*ssh.Client, error) {
+	if client, err := h.dialControl(ctx); err == nil {
+		return client, nil
+	}
+	hops, err := h.Hops()
+	if err != nil {
+		return nil, err
+	}
+	return DialChainContext(ctx, hops...)
+}
+
+// Connects through the host's control master, failing if none is running on ControlPath
+func (h *HostConfig) dialControl(ctx context.Context) (*ssh.Client, error) {
+	if h.ControlPath == "" {
+		return nil, NoControlPath
+	}
+	return DialControlContext(ctx, h.ControlPath)
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testSshConfig = `
+# the options before the first Host apply to every host
+ConnectTimeout 5
+Include conf.d/*.conf
+
+Host bastion
+    HostName bastion.example.com
+    User ops
+    Port 2222
+    IdentityFile ~/.ssh/id_bastion
+
+Host web-* !web-legacy
+    HostName %h.internal.example.com
+    ProxyJump bastion
+    IdentityFile "%d/.ssh/id web"
+
+Match host *.internal.example.com user deploy
+    Port 2200
+
+Host *
+    User default
+    Port 22
+    StrictHostKeyChecking=accept-new
+    UserKnownHostsFile ~/.ssh/known_hosts_%n
+    IdentityFile ~/.ssh/id_default
+`
+
+const testIncludedSshConfig = `
+Host db
+    HostName 10.0.0.5
+    User postgres
+    ProxyJump none
+`
+
+func TestSshConfig(t *testing.T) {
+	Convey("Given an ssh_config with aliases, wildcards, Match and Include", t, func() {
+		dir, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+		configPath := filepath.Join(dir, "config")
+		So(ioutil.WriteFile(configPath, []byte(testSshConfig), 0600), ShouldBeNil)
+		So(os.Mkdir(filepath.Join(dir, "conf.d"), 0700), ShouldBeNil)
+		So(ioutil.WriteFile(filepath.Join(dir, "conf.d", "db.conf"), []byte(testIncludedSshConfig), 0600), ShouldBeNil)
+
+		config, err := LoadSshConfig(configPath, filepath.Join(dir, "missing"))
+		So(err, ShouldBeNil)
+
+		Convey("The first value found for an option should be used", func() {
+			h, err := config.Resolve("bastion")
+			So(err, ShouldBeNil)
+			So(h.HostName, ShouldEqual, "bastion.example.com")
+			So(h.User, ShouldEqual, "ops")
+			So(h.Port, ShouldEqual, 2222)
+			So(h.Addr(), ShouldEqual, "bastion.example.com:2222")
+			So(h.ConnectTimeout, ShouldEqual, 5*time.Second)
+			So(h.HostKeyPolicy, ShouldEqual, HostKeyTrustOnFirstUse)
+			So(h.KnownHostsPath, ShouldEqual, homeDir+"/.ssh/known_hosts_bastion")
+			So(h.IdentityFiles, ShouldResemble, []string{homeDir + "/.ssh/id_bastion", homeDir + "/.ssh/id_default"})
+		})
+
+		Convey("Wildcard hosts should expand %h and respect negated patterns", func() {
+			h, err := config.Resolve("web-1")
+			So(err, ShouldBeNil)
+			So(h.HostName, ShouldEqual, "web-1.internal.example.com")
+			So(h.User, ShouldEqual, "default")
+			So(h.Port, ShouldEqual, 22)
+			So(h.ProxyJump, ShouldEqual, "bastion")
+			So(h.IdentityFiles[0], ShouldEqual, homeDir+"/.ssh/id web")
+
+			h, err = config.Resolve("web-legacy")
+			So(err, ShouldBeNil)
+			So(h.HostName, ShouldEqual, "web-legacy")
+			So(h.ProxyJump, ShouldBeEmpty)
+		})
+
+		Convey("Match should apply to the resolved host name and user", func() {
+			h, err := config.ResolveTarget("deploy@web-2")
+			So(err, ShouldBeNil)
+			So(h.User, ShouldEqual, "deploy")
+			So(h.Port, ShouldEqual, 2200)
+
+			h, err = config.ResolveTarget("deploy@web-2:2022")
+			So(err, ShouldBeNil)
+			So(h.Port, ShouldEqual, 2022)
+		})
+
+		Convey("Included files should be read in place", func() {
+			h, err := config.Resolve("db")
+			So(err, ShouldBeNil)
+			So(h.HostName, ShouldEqual, "10.0.0.5")
+			So(h.User, ShouldEqual, "postgres")
+			So(h.ProxyJump, ShouldBeEmpty)
+		})
+
+		Convey("Unknown hosts should use the defaults and be case insensitive", func() {
+			h, err := config.ResolveTarget("[::1]:2022")
+			So(err, ShouldBeNil)
+			So(h.HostName, ShouldEqual, "::1")
+			So(h.Addr(), ShouldEqual, "[::1]:2022")
+
+			h, err = config.Resolve("BASTION")
+			So(err, ShouldBeNil)
+			So(h.User, ShouldEqual, "ops")
+		})
+
+		Convey("Bad lines should be reported with their location", func() {
+			badPath := filepath.Join(dir, "bad")
+			So(ioutil.WriteFile(badPath, []byte("Host x\n  Match exotic thing\n"), 0600), ShouldBeNil)
+			_, err := LoadSshConfig(badPath)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, badPath+":2:")
+		})
+
+		Convey("A resolved host should be dialable", func() {
+			server, err := startTestServer(newTestPublicKeyServer())
+			So(err, ShouldBeNil)
+			defer server.Close()
+			keyPath := filepath.Join(dir, "id_test")
+			So(ioutil.WriteFile(keyPath, []byte(testPrivateKey), 0600), ShouldBeNil)
+			_, port := splitTestAddr(server.Addr())
+			local := fmt.Sprintf("Host local\n  HostName 127.0.0.1\n  Port %d\n  IdentityFile %s\n  IdentitiesOnly yes\n  StrictHostKeyChecking no\n", port, keyPath)
+			localPath := filepath.Join(dir, "local")
+			So(ioutil.WriteFile(localPath, []byte(local), 0600), ShouldBeNil)
+
+			localConfig, err := LoadSshConfig(localPath)
+			So(err, ShouldBeNil)
+			h, err := localConfig.Resolve("local")
+			So(err, ShouldBeNil)
+			conn, err := h.Dial()
+			So(err, ShouldBeNil)
+			conn.Close()
+		})
+
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+	})
+}
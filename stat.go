@@ -0,0 +1,166 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// The exit status of statCommand when the file does not exist
+const statNotFoundStatus = 2
+
+// The format passed to stat -c. Every field is numeric except for the owner and group names, which come last. This
+// format is understood by both GNU coreutils and BusyBox
+const statFormat = "%f %s %Y %u %g %i %h %U %G"
+
+// RemoteFileInfo describes a remote file as reported by stat, or by sftp when the server can't run stat. It
+// implements os.FileInfo, and symbolic links are described rather than followed
+type RemoteFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+
+	// The owner and group names, which sftp does not report, leaving them empty
+	Owner string
+	Group string
+	Uid   int
+	Gid   int
+	// The number of hard links to the file and its inode, which sftp does not report, leaving them 0
+	Links uint64
+	Inode uint64
+	// The target of a symbolic link, or empty for other files
+	LinkTarget string
+}
+
+func (fi *RemoteFileInfo) Name() string       { return fi.name }
+func (fi *RemoteFileInfo) Size() int64        { return fi.size }
+func (fi *RemoteFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *RemoteFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *RemoteFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *RemoteFileInfo) Sys() interface{}   { return nil }
+
+// Describes the file at remotePath from the attributes sftp returned for it
+func sftpFileInfo(remotePath string, fi os.FileInfo) *RemoteFileInfo {
+	info := &RemoteFileInfo{name: path.Base(remotePath), size: fi.Size(), mode: fi.Mode(), modTime: fi.ModTime()}
+	if stat, ok := fi.Sys().(*sftp.FileStat); ok {
+		// the raw mode carries the setuid, setgid and sticky bits as stat's does
+		info.mode = unixModeToFileMode(stat.Mode)
+		info.Uid = int(stat.UID)
+		info.Gid = int(stat.GID)
+	}
+	return info
+}
+
+// Returns a shell command which exits with statNotFoundStatus if remotePath does not exist, and otherwise prints a
+// line in statFormat followed by a line with the link target if it is a symbolic link. The C locale is used so that
+// the output does not depend on the remote machine's language settings
+func statCommand(remotePath string) string {
+	return fmt.Sprintf(`f=%s; if [ ! -e "$f" ] && [ ! -L "$f" ]; then exit %d; fi; `+
+		`LC_ALL=C stat -c %s -- "$f" && if [ -L "$f" ]; then readlink -- "$f"; fi`, ShellQuote(remotePath), statNotFoundStatus, ShellQuote(statFormat))
+}
+
+// Parses the output of statCommand for the file at remotePath
+func parseStat(remotePath string, output []byte) (*RemoteFileInfo, error) {
+	lines := strings.SplitN(strings.TrimSuffix(string(output), "\n"), "\n", 2)
+	fields := strings.Fields(lines[0])
+	if len(fields) < 9 {
+		return nil, fmt.Errorf("Unexpected stat output: %q", lines[0])
+	}
+
+	var numbers [7]uint64
+	for i := range numbers {
+		base := 10
+		// the raw mode is printed in hex
+		if i == 0 {
+			base = 16
+		}
+		n, err := strconv.ParseUint(fields[i], base, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected stat output: %q", lines[0])
+		}
+		numbers[i] = n
+	}
+
+	info := &RemoteFileInfo{
+		name:    path.Base(remotePath),
+		mode:    unixModeToFileMode(uint32(numbers[0])),
+		size:    int64(numbers[1]),
+		modTime: time.Unix(int64(numbers[2]), 0),
+		Uid:     int(numbers[3]),
+		Gid:     int(numbers[4]),
+		Inode:   numbers[5],
+		Links:   numbers[6],
+		Owner:   fields[7],
+		Group:   strings.Join(fields[8:], " "),
+	}
+	if len(lines) == 2 {
+		info.LinkTarget = lines[1]
+	}
+	return info, nil
+}
+
+// Unix file type bits of st_mode
+const (
+	unixTypeMask = 0170000
+	unixSocket   = 0140000
+	unixSymlink  = 0120000
+	unixBlock    = 0060000
+	unixDir      = 0040000
+	unixChar     = 0020000
+	unixFifo     = 0010000
+)
+
+// Converts a unix st_mode into an os.FileMode
+func unixModeToFileMode(mode uint32) os.FileMode {
+	fileMode := os.FileMode(mode & 0777)
+	switch mode & unixTypeMask {
+	case unixSocket:
+		fileMode |= os.ModeSocket
+	case unixSymlink:
+		fileMode |= os.ModeSymlink
+	case unixBlock:
+		fileMode |= os.ModeDevice
+	case unixDir:
+		fileMode |= os.ModeDir
+	case unixChar:
+		fileMode |= os.ModeDevice | os.ModeCharDevice
+	case unixFifo:
+		fileMode |= os.ModeNamedPipe
+	}
+	if mode&04000 != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		fileMode |= os.ModeSticky
+	}
+	return fileMode
+}
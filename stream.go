@@ -0,0 +1,189 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The size of the reads made for a stream delivering chunks
+const streamChunkSize = 32 * 1024
+
+// OutputFunc receives a line, without its newline, or a chunk of a streaming command's output. data is not reused and
+// may be retained
+type OutputFunc func(data []byte)
+
+// StreamOptions says where a streaming command's output goes
+type StreamOptions struct {
+	// Called with each line or chunk of stdout and of stderr, from a goroutine for each. Output without a function
+	// is discarded
+	Stdout OutputFunc
+	Stderr OutputFunc
+	// Deliver output in chunks as soon as it is received instead of in lines
+	Chunks bool
+}
+
+// StreamOutput is a line or chunk of a streaming command's output, as sent by StreamChannel
+type StreamOutput struct {
+	Stderr bool
+	Data   []byte
+}
+
+// Stream is a running remote command whose output is delivered as it is produced. Writes to the stream go to the
+// command's stdin
+type Stream struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	// finished once stdout and stderr have been read to the end
+	output sync.WaitGroup
+
+	// closed once the command exits, when result and err are set
+	done   chan struct{}
+	result *Result
+	err    error
+}
+
+// Starts cmd in a new session, delivering its output as options say until it exits
+func StartStream(conn *ssh.Client, cmd string, options StreamOptions) (*Stream, error) {
+	return StartStreamContext(context.Background(), conn, cmd, options)
+}
+
+// Starts cmd like StartStream, closing the session if ctx is done before cmd exits
+func StartStreamContext(ctx context.Context, conn *ssh.Client, cmd string, options StreamOptions) (*Stream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stdin, stdout, stderr, session, err := getPipesAndSession(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := session.Start(cmd); err != nil {
+		session.Close()
+		return nil, err
+	}
+	s := &Stream{session: session, stdin: stdin, done: make(chan struct{})}
+	s.output.Add(2)
+	go s.read(stdout, options.Stdout, options.Chunks)
+	go s.read(stderr, options.Stderr, options.Chunks)
+	go s.wait(ctx, cmd, time.Now())
+	return s, nil
+}
+
+// Starts cmd like StartStreamContext, sending its output on the returned channel, which is closed once the output
+// ends. The channel must be received from until it is closed or the command will stall
+func StreamChannel(ctx context.Context, conn *ssh.Client, cmd string, chunks bool) (*Stream, <-chan StreamOutput, error) {
+	output := make(chan StreamOutput)
+	s, err := StartStreamContext(ctx, conn, cmd, StreamOptions{
+		Stdout: func(data []byte) {
+			output <- StreamOutput{Data: data}
+		},
+		Stderr: func(data []byte) {
+			output <- StreamOutput{Stderr: true, Data: data}
+		},
+		Chunks: chunks,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		s.output.Wait()
+		close(output)
+	}()
+	return s, output, nil
+}
+
+// Reads r to the end, passing each line or chunk to f
+func (s *Stream) read(r io.Reader, f OutputFunc, chunks bool) {
+	defer s.output.Done()
+	if f == nil {
+		io.Copy(io.Discard, r)
+		return
+	}
+	if chunks {
+		buf := make([]byte, streamChunkSize)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				f(append([]byte(nil), buf[:n]...))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			line = line[:len(line)-1]
+		} else if len(line) == 0 && err != nil {
+			return
+		}
+		f(line)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Waits for the command to exit after all of its output is delivered, then records its result
+func (s *Stream) wait(ctx context.Context, cmd string, start time.Time) {
+	defer close(s.done)
+	defer s.session.Close()
+	err := withContext(ctx, s.session, func() error {
+		s.output.Wait()
+		return s.session.Wait()
+	})
+	s.result, s.err = newResult(cmd, nil, nil, time.Since(start), err)
+}
+
+// Writes p to the command's stdin
+func (s *Stream) Write(p []byte) (int, error) {
+	return s.stdin.Write(p)
+}
+
+// Closes the command's stdin, so that it reads end of file
+func (s *Stream) CloseStdin() error {
+	return s.stdin.Close()
+}
+
+// Sends a signal to the command. Many servers ignore signal requests
+func (s *Stream) Signal(sig ssh.Signal) error {
+	return s.session.Signal(sig)
+}
+
+// Waits for the command to exit and all of its output to be delivered, returning how it exited like Run. The
+// result's Stdout and Stderr are empty, as the output went to the stream's functions
+func (s *Stream) Wait() (*Result, error) {
+	<-s.done
+	return s.result, s.err
+}
+
+// Closes the session, which terminates the command if it is still running
+func (s *Stream) Close() error {
+	return s.session.Close()
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2015 Christopher Cooper
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ssh
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStream(t *testing.T) {
+	Convey("Given a connection to an ssh server", t, func() {
+		_, conn := newTestConn(t)
+
+		var mu sync.Mutex
+		var stdout, stderr []string
+		options := StreamOptions{
+			Stdout: func(data []byte) {
+				mu.Lock()
+				stdout = append(stdout, string(data))
+				mu.Unlock()
+			},
+			Stderr: func(data []byte) {
+				mu.Lock()
+				stderr = append(stderr, string(data))
+				mu.Unlock()
+			},
+		}
+
+		Convey("Output should be delivered line by line", func() {
+			stream, err := StartStream(conn, "echo one; echo oops >&2; printf 'two\\nthree'", options)
+			So(err, ShouldBeNil)
+			result, err := stream.Wait()
+			So(err, ShouldBeNil)
+			So(result.Success(), ShouldBeTrue)
+			So(stdout, ShouldResemble, []string{"one", "two", "three"})
+			So(stderr, ShouldResemble, []string{"oops"})
+		})
+
+		Convey("Output should be delivered in chunks", func() {
+			options.Chunks = true
+			stream, err := StartStream(conn, "printf 'a\\nb'", options)
+			So(err, ShouldBeNil)
+			_, err = stream.Wait()
+			So(err, ShouldBeNil)
+			So(stdout, ShouldResemble, []string{"a\nb"})
+		})
+
+		Convey("Lines should arrive while the command runs, in response to stdin", func() {
+			stream, output, err := StreamChannel(context.Background(), conn, "cat", false)
+			So(err, ShouldBeNil)
+			_, err = stream.Write([]byte("ping\n"))
+			So(err, ShouldBeNil)
+			So(string((<-output).Data), ShouldEqual, "ping")
+			_, err = stream.Write([]byte("pong\n"))
+			So(err, ShouldBeNil)
+			So(string((<-output).Data), ShouldEqual, "pong")
+
+			So(stream.CloseStdin(), ShouldBeNil)
+			_, open := <-output
+			So(open, ShouldBeFalse)
+			result, err := stream.Wait()
+			So(err, ShouldBeNil)
+			So(result.ExitStatus, ShouldEqual, 0)
+		})
+
+		Convey("The exit status should be delivered with a CommandError", func() {
+			stream, err := StartStream(conn, "echo done; exit 4", options)
+			So(err, ShouldBeNil)
+			result, err := stream.Wait()
+			var cmdErr *CommandError
+			So(errors.As(err, &cmdErr), ShouldBeTrue)
+			So(result.ExitStatus, ShouldEqual, 4)
+			So(stdout, ShouldResemble, []string{"done"})
+		})
+
+		Convey("The command should be stopped when the context is done", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			stream, err := StartStreamContext(ctx, conn, "echo started; sleep 10", options)
+			So(err, ShouldBeNil)
+			_, err = stream.Wait()
+			So(err, ShouldEqual, context.DeadlineExceeded)
+			So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+			So(stdout, ShouldResemble, []string{"started"})
+		})
+	})
+}